@@ -0,0 +1,82 @@
+// virt-collectd-exporter brings collectd metrics to prometheus
+// Copyright 2017 Red Hat Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/fromanirh/virt-collectd-exporter/internal/pkg/collectd"
+	"github.com/prometheus/client_golang/prometheus"
+	flag "github.com/spf13/pflag"
+)
+
+// replayMain implements the replay subcommand, which feeds a recording
+// made with --record-file to a Collector with no data sources:
+//
+//	virt-collectd-exporter replay [flags] RECORDING
+//
+// The metrics are served as usual until the exporter is stopped, or,
+// with --dump, printed once the recording is replayed.
+func replayMain() {
+	speed := flag.Float64("speed", 1, "Replay speed, relative to the recording. 0 replays as fast as possible.")
+	keepTime := flag.Bool("keep-time", false, "Keep the original time of the value lists, instead of shifting it to the replay time.")
+	dump := flag.Bool("dump", false, "Print the metrics once the recording is replayed, and exit.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] RECORDING\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	conf := collectd.ConfigFromCommandLine().WithoutSources()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	conf.ReplayFile = flag.Arg(0)
+	conf.ReplaySpeed = *speed
+	conf.ReplayKeepTime = *keepTime
+
+	coll := collectd.NewCollector(conf)
+	if conf.DebugLog {
+		coll.SetDebugLog(log.New(os.Stderr, log.Prefix(), log.LstdFlags))
+	}
+	if err := coll.Configure(conf); err != nil {
+		log.Fatalf("Collector configuration failed: %s", err)
+	}
+	prometheus.MustRegister(coll)
+
+	reloadOnSignal(coll)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelOnSignal(cancel)
+
+	if *dump {
+		// stopping the collector stores the value lists still queued
+		go func() {
+			<-coll.Replayed()
+			cancel()
+		}()
+	}
+	if err := coll.Run(ctx); err != nil {
+		log.Fatalf("Collector failed: %s", err)
+	}
+	if *dump {
+		if err := coll.DumpValues(os.Stdout); err != nil {
+			log.Fatalf("Dumping the metrics failed: %s", err)
+		}
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/fromanirh/virt-collectd-exporter/internal/pkg/collectd"
 	"github.com/prometheus/client_golang/prometheus"
@@ -31,6 +33,12 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		replayMain()
+		return
+	}
+
 	conf := collectd.ConfigFromCommandLine()
 	log.Printf("Config: %#v", conf)
 
@@ -50,6 +58,34 @@ func main() {
 
 	prometheus.MustRegister(coll)
 
+	reloadOnSignal(coll)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelOnSignal(cancel)
+
 	log.Printf("Running")
-	coll.Run(context.Background())
+	if err := coll.Run(ctx); err != nil {
+		log.Fatalf("Collector failed: %s", err)
+	}
+}
+
+// reloadOnSignal reloads the configuration of coll on SIGHUP.
+func reloadOnSignal(coll *collectd.Collector) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			coll.Reload()
+		}
+	}()
+}
+
+// cancelOnSignal calls cancel on SIGINT or SIGTERM.
+func cancelOnSignal(cancel context.CancelFunc) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-term
+		log.Printf("Received %s, terminating", sig)
+		cancel()
+	}()
 }
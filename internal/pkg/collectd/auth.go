@@ -0,0 +1,205 @@
+package collectd
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// parseCredentialsFile reads a file in the format of the collectd auth
+// file: one "key: value" entry per line. Blank lines and lines starting
+// with '#' are ignored.
+func parseCredentialsFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'key: value'", filename, lineno)
+		}
+		entries[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return entries, scanner.Err()
+}
+
+// httpAuth authenticates the clients of an HTTP receiver, and tells
+// which hosts they may report values for.
+type httpAuth struct {
+	// users maps the basic auth users to their passwords
+	users map[string]string
+	// tokens maps the bearer tokens to the identities
+	tokens map[string]string
+	// hosts maps the identities to the host name patterns they may
+	// report for; nil if any client may report for any host
+	hosts map[string][]string
+}
+
+type identityKey struct{}
+
+func loadHTTPAuth(authPath, tokensPath, authzPath string) (*httpAuth, error) {
+	a := &httpAuth{}
+	var err error
+	if authPath != "" {
+		if a.users, err = parseCredentialsFile(authPath); err != nil {
+			return nil, err
+		}
+		log.Printf("HTTP auth file: '%s'", authPath)
+	}
+	if tokensPath != "" {
+		identities, err := parseCredentialsFile(tokensPath)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = make(map[string]string, len(identities))
+		for identity, token := range identities {
+			if token == "" {
+				return nil, fmt.Errorf("%s: empty token for '%s'", tokensPath, identity)
+			}
+			a.tokens[token] = identity
+		}
+		log.Printf("HTTP bearer tokens file: '%s'", tokensPath)
+	}
+	if authzPath != "" {
+		entries, err := parseCredentialsFile(authzPath)
+		if err != nil {
+			return nil, err
+		}
+		a.hosts = make(map[string][]string, len(entries))
+		for identity, patterns := range entries {
+			for _, pattern := range strings.Fields(patterns) {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("%s: bad pattern '%s' for '%s'", authzPath, pattern, identity)
+				}
+				a.hosts[identity] = append(a.hosts[identity], pattern)
+			}
+		}
+		log.Printf("HTTP authorization file: '%s'", authzPath)
+	}
+	return a, nil
+}
+
+// authenticate finds the identity of the client of r: the basic auth
+// user or the bearer token owner if the request has an Authorization
+// header, else the common name of the verified client certificate.
+// Credentials are required if users or tokens are configured; else the
+// Authorization header is ignored, as write_http may send its User and
+// Password to an exporter without authentication.
+func (a *httpAuth) authenticate(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" && a.required() {
+		if user, password, ok := r.BasicAuth(); ok {
+			expected, known := a.users[user]
+			if !known {
+				// compare anyway, not to tell the known users apart
+				expected = "\x00"
+			}
+			match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+			return user, known && match
+		}
+		if strings.HasPrefix(header, "Bearer ") {
+			token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+			for t, identity := range a.tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					return identity, true
+				}
+			}
+		}
+		return "", false
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	return "", !a.required()
+}
+
+// required tells if the clients must present credentials.
+func (a *httpAuth) required() bool {
+	return len(a.users) > 0 || len(a.tokens) > 0
+}
+
+// authorized tells if identity may report values for host.
+func (a *httpAuth) authorized(identity, host string) bool {
+	if a.hosts == nil {
+		return true
+	}
+	for _, pattern := range a.hosts[identity] {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAuth rejects the requests whose client cannot be authenticated.
+// The identity of the client is stored in the request context.
+func requireAuth(auth func() *httpAuth, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth().authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="collectd"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// requestIdentity returns the identity stored by requireAuth.
+func requestIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+// loadTLSConfig builds the TLS configuration of a server. If clientCAFile
+// is not empty, the clients must present a certificate signed by one of
+// its CAs.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("Client CA file set without certificate and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in '%s'", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
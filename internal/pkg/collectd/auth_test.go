@@ -0,0 +1,108 @@
+package collectd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return filename
+}
+
+func TestHTTPAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth, err := loadHTTPAuth(
+		writeTestFile(t, dir, "auth", "# collectd users\nalice: secret\n\nbob: pass:word\n"),
+		writeTestFile(t, dir, "tokens", "agent: t0ken\n"),
+		writeTestFile(t, dir, "authz", "alice: vm* db1\nagent: *\n"),
+	)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	handler := requireAuth(func() *httpAuth { return auth }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestIdentity(r)))
+	}))
+	testCases := []struct {
+		user, password, bearer string
+		status                 int
+		identity               string
+	}{
+		{status: http.StatusUnauthorized},
+		{user: "alice", password: "secret", status: http.StatusOK, identity: "alice"},
+		{user: "bob", password: "pass:word", status: http.StatusOK, identity: "bob"},
+		{user: "alice", password: "wrong", status: http.StatusUnauthorized},
+		{user: "mallory", password: "secret", status: http.StatusUnauthorized},
+		{bearer: "t0ken", status: http.StatusOK, identity: "agent"},
+		{bearer: "wrong", status: http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("POST", "/collectd", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		if tc.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%+v: got status %d, expected %d", tc, rec.Code, tc.status)
+		}
+		if tc.status == http.StatusOK && rec.Body.String() != tc.identity {
+			t.Errorf("%+v: got identity '%s'", tc, rec.Body.String())
+		}
+	}
+
+	for _, tc := range []struct {
+		identity, host string
+		allowed        bool
+	}{
+		{"alice", "vm0", true},
+		{"alice", "db1", true},
+		{"alice", "db2", false},
+		{"bob", "vm0", false},
+		{"agent", "db2", true},
+	} {
+		if got := auth.authorized(tc.identity, tc.host); got != tc.allowed {
+			t.Errorf("%s on %s: got %v, expected %v", tc.identity, tc.host, got, tc.allowed)
+		}
+	}
+
+	// without users nor tokens, anonymous clients may report for any host
+	anonymous, err := loadHTTPAuth("", "", "")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, ok := anonymous.authenticate(httptest.NewRequest("POST", "/collectd", nil)); !ok || !anonymous.authorized("", "vm0") {
+		t.Errorf("anonymous client rejected")
+	}
+	withCredentials := httptest.NewRequest("POST", "/collectd", nil)
+	withCredentials.SetBasicAuth("alice", "secret")
+	if _, ok := anonymous.authenticate(withCredentials); !ok {
+		t.Errorf("client with unneeded credentials rejected")
+	}
+
+	if _, err := loadHTTPAuth(writeTestFile(t, dir, "bad", "alice\n"), "", ""); err == nil {
+		t.Errorf("unexpected success for a malformed auth file")
+	}
+	if _, err := loadHTTPAuth("", "", writeTestFile(t, dir, "badz", "alice: [\n")); err == nil {
+		t.Errorf("unexpected success for a malformed pattern")
+	}
+	if _, err := loadTLSConfig("", "", filepath.Join(dir, "ca.pem")); err == nil {
+		t.Errorf("unexpected success for a client CA without certificate")
+	}
+}
@@ -3,13 +3,16 @@ package collectd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"collectd.org/api"
-	"collectd.org/network"
 
 	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
 	"github.com/gorilla/mux"
@@ -21,51 +24,159 @@ var UnknownSecurityLevel = errors.New("Unknown security level")
 
 const Name = "virt_collectd_exporter"
 
+// maxClockSkew is how far in the future the time of a sample may be. A
+// sample further ahead, from a sender with a wrong clock, would keep all
+// the others of its series out until its time comes.
+const maxClockSkew = time.Minute
+
 type dataCollector interface {
 	Configure(Config) error
-	Run(context.Context)
+	Run(context.Context) error
 	Describe(ch chan<- *prometheus.Desc)
+	Collect(ch chan<- prometheus.Metric)
 }
 
 type dataSink interface {
 	Write(context.Context, *api.ValueList) error
 }
 
+// metaSink is implemented by the sinks which keep the collectd meta data
+// of the value lists, for the protocols carrying them.
+type metaSink interface {
+	dataSink
+	WriteMeta(context.Context, *api.ValueList, nameconv.Meta) error
+}
+
+// reloadableCollector is implemented by the data collectors which can
+// pick up configuration changes at runtime. PrepareReload validates the
+// new configuration and returns the function which makes it effective.
+type reloadableCollector interface {
+	PrepareReload(Config) (func(), error)
+}
+
 type Collector struct {
-	ch       chan api.ValueList
-	values   map[string]api.ValueList
-	rw       *sync.RWMutex
-	srcs     []dataCollector
-	address  string
-	router   *mux.Router
-	conv     *nameconv.NameConverter
-	debugLog *log.Logger
+	queue         *sampleQueue
+	notifications *notificationStore
+	values        map[string]sample
+	conflicts     map[string]bool
+	stopped       map[string]time.Time
+	staleness     stalenessPolicy
+	rw            *sync.RWMutex
+	reloadLock    sync.Mutex
+	srcs          []dataCollector
+	address       string
+	router        *mux.Router
+	web           atomic.Value // *webConfig
+	conv          *nameconv.NameConverter
+	conf          Config
+	reload        *reloadMetrics
+	ingest        *ingestMetrics
+	store         *storeMetrics
+	relays        []*relay
+	relaySources  map[string]bool
+	relayMetrics  *relayMetrics
+	recorder      *recorder
+	replayer      *replayCollector
+	debugLog      *log.Logger
+	// confErr is the configuration error found by NewCollector,
+	// returned by Configure
+	confErr error
 }
 
 func NewCollector(conf Config) *Collector {
 	c := &Collector{
-		ch:     make(chan api.ValueList, 0),
-		values: make(map[string]api.ValueList),
-		rw:     &sync.RWMutex{},
+		values:    make(map[string]sample),
+		conflicts: make(map[string]bool),
+		stopped:   make(map[string]time.Time),
+		rw:        &sync.RWMutex{},
+		reload:    newReloadMetrics(),
+		ingest:    newIngestMetrics(),
+
+		relaySources: make(map[string]bool),
+		relayMetrics: newRelayMetrics(),
 	}
-	if conf.CollectdBinaryAddress != "" {
-		log.Printf("CollectD binary protocol endpoint: '%s'", conf.CollectdBinaryAddress)
+	c.store = newStoreMetrics(c)
+	listeners, err := binaryListeners(conf)
+	if err != nil {
+		c.confErr = err
+	}
+	for _, l := range listeners {
+		log.Printf("CollectD binary protocol endpoint: '%s' (%s)", l.address, l.source)
 		bin := &binaryProtoCollector{
-			address: conf.CollectdBinaryAddress,
-			srv: &network.Server{
-				Addr:   conf.CollectdBinaryAddress,
-				Writer: c,
-			},
+			listener: l,
+			sink:     sourceSink{c, l.source},
+			notifier: sourceSink{c, l.source},
+			metrics:  c.ingest,
 		}
 		c.srcs = append(c.srcs, bin)
+		c.relaySources[l.source] = true
 	}
 	if conf.CollectdJSONAddress != "" {
 		log.Printf("CollectD HTTP JSON protocol endpoint: '%s'", conf.CollectdJSONAddress)
 		hj := &httpJSONCollector{
-			address: conf.CollectdJSONAddress,
-			sink:    c,
+			address:    conf.CollectdJSONAddress,
+			sink:       sourceSink{c, "json"},
+			notifier:   sourceSink{c, "json"},
+			influxSink: sourceSink{c, "influxdb"},
+			metrics:    c.ingest,
+			web:        c.webConfig,
 		}
 		c.srcs = append(c.srcs, hj)
+		c.relaySources["json"] = true
+	}
+	if conf.CollectdGraphiteAddress != "" {
+		log.Printf("CollectD graphite protocol endpoint: '%s'", conf.CollectdGraphiteAddress)
+		gr := &graphiteCollector{
+			address: conf.CollectdGraphiteAddress,
+			sink:    sourceSink{c, "graphite"},
+			metrics: c.ingest,
+		}
+		c.srcs = append(c.srcs, gr)
+	}
+	if conf.CollectdInfluxDBUDPAddress != "" {
+		log.Printf("CollectD InfluxDB UDP endpoint: '%s'", conf.CollectdInfluxDBUDPAddress)
+		iu := &influxUDPCollector{
+			address: conf.CollectdInfluxDBUDPAddress,
+			sink:    sourceSink{c, "influxdb"},
+			metrics: c.ingest,
+		}
+		c.srcs = append(c.srcs, iu)
+	}
+	if conf.CollectdUnixsockPath != "" {
+		log.Printf("CollectD unixsock socket: '%s'", conf.CollectdUnixsockPath)
+		us := &unixsockCollector{
+			path:    conf.CollectdUnixsockPath,
+			sink:    sourceSink{c, "unixsock"},
+			metrics: c.ingest,
+		}
+		c.srcs = append(c.srcs, us)
+	}
+	if conf.CollectdScrapeURL != "" {
+		log.Printf("CollectD write_prometheus endpoint: '%s'", conf.CollectdScrapeURL)
+		sc := &scrapeCollector{
+			url:     conf.CollectdScrapeURL,
+			sink:    sourceSink{c, "scrape"},
+			metrics: c.ingest,
+		}
+		c.srcs = append(c.srcs, sc)
+	}
+	if conf.ReplayFile != "" {
+		log.Printf("Replaying: '%s'", conf.ReplayFile)
+		c.replayer = &replayCollector{
+			filename: conf.ReplayFile,
+			c:        c,
+			done:     make(chan struct{}),
+		}
+		c.srcs = append(c.srcs, c.replayer)
+	}
+	for _, spec := range conf.CollectdRelays {
+		upstream, err := parseRelayUpstream(spec)
+		if err != nil {
+			c.confErr = err
+			break
+		}
+		log.Printf("CollectD relay upstream: '%s'", upstream.address)
+		c.relays = append(c.relays, newRelay(upstream, c.relayMetrics))
 	}
 	c.conv, _ = nameconv.NewNameConverter(conf.MetricsSource, conf.MetricsPrefix)
 	return c
@@ -76,7 +187,58 @@ func (c *Collector) SetDebugLog(l *log.Logger) *Collector {
 	return c
 }
 
+func loadNameConverter(conf Config) (*nameconv.NameConverter, error) {
+	if conf.MappingFile == "" {
+		return nameconv.NewNameConverter(conf.MetricsSource, conf.MetricsPrefix)
+	}
+	cm, err := nameconv.LoadConfMap(conf.MappingFile)
+	if err != nil {
+		return nil, err
+	}
+	if cm.Source == "" {
+		cm.Source = conf.MetricsSource
+	}
+	if cm.Prefix == "" {
+		cm.Prefix = conf.MetricsPrefix
+	}
+	conv, err := nameconv.NewNameConverterWithConfMap(cm)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mapping file '%s': %s", conf.MappingFile, err)
+	}
+	log.Printf("Name mapping file: '%s'", conf.MappingFile)
+	return conv, nil
+}
+
 func (c *Collector) Configure(conf Config) error {
+	if c.confErr != nil {
+		return c.confErr
+	}
+	conv, err := loadNameConverter(conf)
+	if err != nil {
+		if c.debugLog != nil {
+			c.debugLog.Printf("Configure failed: %s", err)
+		}
+		return err
+	}
+	c.conv = conv
+	c.conf = conf
+
+	c.staleness, err = parseStalenessPolicy(conf)
+	if err != nil {
+		return err
+	}
+
+	c.queue, err = newSampleQueue(conf.QueueSize, conf.QueuePolicy)
+	if err != nil {
+		return err
+	}
+	log.Printf("Sample queue: size %d policy '%s'", conf.QueueSize, conf.QueuePolicy)
+
+	c.notifications, err = newNotificationStore(conf.NotificationsSize, conf.NotificationsGauge)
+	if err != nil {
+		return err
+	}
+
 	for _, src := range c.srcs {
 		if c.debugLog != nil {
 			c.debugLog.Printf("Configuring: %#v", src)
@@ -89,6 +251,25 @@ func (c *Collector) Configure(conf Config) error {
 		}
 	}
 
+	if conf.RecordFile != "" {
+		c.recorder, err = newRecorder(conf.RecordFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	web, err := loadWebConfig(conf.WebConfigFile)
+	if err != nil {
+		return err
+	}
+	c.web.Store(web)
+
+	for _, r := range c.relays {
+		if err := r.Configure(conf); err != nil {
+			return err
+		}
+	}
+
 	c.address = conf.MetricsAddress
 	c.router = mux.NewRouter().StrictSlash(true)
 	name := "metrics"
@@ -97,6 +278,20 @@ func (c *Collector) Configure(conf Config) error {
 		Path(conf.MetricsURLPath).
 		Name(name).
 		Handler(Logger(promhttp.Handler(), name))
+	name = "reload"
+	c.router.
+		Methods("POST").
+		Path("/-/reload").
+		Name(name).
+		Handler(Logger(http.HandlerFunc(c.handleReload), name))
+	name = "notifications"
+	c.router.
+		Methods("GET").
+		Path("/notifications").
+		Name(name).
+		Handler(Logger(c.notifications, name))
+
+	c.reload.succeeded()
 
 	if c.debugLog != nil {
 		c.debugLog.Printf("Collector configured\n")
@@ -105,64 +300,317 @@ func (c *Collector) Configure(conf Config) error {
 	return nil
 }
 
-func (c *Collector) Run(ctx context.Context) {
+// Run serves until ctx is cancelled or any listener fails. On the way
+// out, it stops all the data sources and the metrics endpoint, then
+// waits for the samples already received to be stored.
+func (c *Collector) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, len(c.srcs)+1)
+	run := func(wg *sync.WaitGroup, name string, fn func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx); err != nil {
+				log.Printf("%s failed: %s", name, err)
+				errc <- err
+				cancel()
+			}
+		}()
+	}
+
 	log.Printf("Sample processing loop: starting")
-	go c.processSamples()
+	processed := make(chan struct{})
+	go func() {
+		c.processSamples()
+		close(processed)
+	}()
+
+	// the relays outlive the sources, to forward all they received
+	relayCtx, relayCancel := context.WithCancel(context.Background())
+	defer relayCancel()
+	relaysWG := &sync.WaitGroup{}
+	for _, r := range c.relays {
+		r := r
+		relaysWG.Add(1)
+		go func() {
+			defer relaysWG.Done()
+			r.Run(relayCtx)
+		}()
+	}
 
 	log.Printf("Enabling data sources...")
+	srcsWG := &sync.WaitGroup{}
 	for _, src := range c.srcs {
-		go src.Run(ctx)
+		run(srcsWG, fmt.Sprintf("%T", src), src.Run)
 	}
 
 	log.Printf("Prometheus endpoint: starting")
-	log.Fatal(http.ListenAndServe(c.address, c.router))
+	metricsWG := &sync.WaitGroup{}
+	srv := &http.Server{
+		Addr:    c.address,
+		Handler: webHandler(c.webConfig, nil, c.router),
+	}
+	setupWebServer(srv, c.webConfig)
+	run(metricsWG, "Prometheus endpoint", func(ctx context.Context) error {
+		return runHTTPServer(ctx, srv)
+	})
+
+	<-ctx.Done()
+	log.Printf("Shutting down")
+
+	// sources first, so the in-flight samples can still be stored
+	srcsWG.Wait()
+	relayCancel()
+	relaysWG.Wait()
+	c.queue.close()
+	<-processed
+	metricsWG.Wait()
+	if c.recorder != nil {
+		if err := c.recorder.close(); err != nil {
+			log.Printf("Closing the recording failed: %s", err)
+		}
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
 }
 
-func (c Collector) processSamples() {
-	ticker := time.NewTicker(time.Minute).C
+// processSamples stores the incoming samples until the queue is closed.
+// The expired series are purged as often as the smallest interval.
+func (c *Collector) processSamples() {
+	tick := purgeInterval(0)
+	timer := time.NewTimer(tick)
+	defer timer.Stop()
 	for {
 		if c.debugLog != nil {
 			c.debugLog.Printf("Processing samples")
 		}
 
 		select {
-		case vl := <-c.ch:
-			c.update(vl)
+		case s, ok := <-c.queue.ch:
+			if !ok {
+				log.Printf("Sample processing loop: done")
+				return
+			}
+			c.update(s)
+			if next := purgeInterval(s.vl.Interval); next < tick {
+				tick = next
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(tick)
+			}
 
-		case <-ticker:
-			c.purge(time.Now())
+		case <-timer.C:
+			tick = purgeInterval(c.purge(time.Now()))
+			timer.Reset(tick)
 		}
 	}
 }
 
-func (c Collector) update(vl api.ValueList) {
-	id := vl.Identifier.String()
+// update stores s, unless it is not newer than the value list already
+// stored for its identifier: a delayed packet, or another collectd
+// reporting for the same host, must not move the values backwards. The
+// samples too far in the future are rejected too.
+func (c *Collector) update(s sample) {
+	id := s.vl.Identifier.String()
 	if c.debugLog != nil {
 		c.debugLog.Printf("Updating: %s", id)
 	}
 	c.rw.Lock()
-	c.values[id] = vl
-	c.rw.Unlock()
+	defer c.rw.Unlock()
+	if s.vl.Plugin == "virt" {
+		key := domainKey(s.vl.Host, s.vl.PluginInstance)
+		if stop, ok := c.stopped[key]; ok {
+			if !s.vl.Time.After(stop) {
+				if c.debugLog != nil {
+					c.debugLog.Printf("Rejecting sample of stopped domain: %s", id)
+				}
+				return
+			}
+			delete(c.stopped, key)
+		}
+	}
+	if s.vl.Time.After(time.Now().Add(maxClockSkew)) {
+		c.reject(id, s, storeFuture)
+		return
+	}
+	if old, ok := c.values[id]; ok {
+		if c.conf.DetectConflicts && conflicting(old, s) {
+			c.store.conflicts.WithLabelValues(s.vl.Host).Inc()
+			if !c.conflicts[id] {
+				log.Printf("Conflicting values for %s from '%s' and '%s'", id, old.sender, s.sender)
+				c.conflicts[id] = true
+			}
+		}
+		if !s.vl.Time.After(old.vl.Time) {
+			reason := storeOutOfOrder
+			if s.vl.Time.Equal(old.vl.Time) {
+				reason = storeDuplicate
+			}
+			c.reject(id, s, reason)
+			return
+		}
+	}
+	c.values[id] = s
 }
 
-func (c Collector) purge(now time.Time) {
+// reject accounts for a sample not stored.
+func (c *Collector) reject(id string, s sample, reason string) {
+	if c.debugLog != nil {
+		c.debugLog.Printf("Rejecting %s sample: %s", reason, id)
+	}
+	c.store.rejected.WithLabelValues(s.vl.Host, reason).Inc()
+}
+
+// conflicting tells if a and b, of the same identifier, look like
+// reported by different collectd instances: they come from different
+// senders, less than an interval apart, with different values.
+func conflicting(a, b sample) bool {
+	if a.sender == "" || b.sender == "" || a.sender == b.sender {
+		return false
+	}
+	delta := b.vl.Time.Sub(a.vl.Time)
+	if delta < 0 {
+		delta = -delta
+	}
+	if delta >= a.vl.Interval {
+		return false
+	}
+	return !reflect.DeepEqual(a.vl.Values, b.vl.Values)
+}
+
+// purge drops the expired series, and returns the smallest interval of
+// the others. A virt domain is taken as stopped, even if it was not
+// notified, once none of its series is fresh: a single expired series is
+// only a device gone, e.g. a detached disk.
+func (c *Collector) purge(now time.Time) time.Duration {
+	var smallest time.Duration
+	fresh := make(map[string]bool)
+	stopped := make(map[string]bool)
+	instances := make(map[api.Identifier]bool)
 	c.rw.Lock()
-	for id, vl := range c.values {
-		expiration := vl.Time.Add(vl.Interval)
-		if expiration.Before(now) {
-			if c.debugLog != nil {
-				c.debugLog.Printf("Purging: %s", id)
+	defer c.rw.Unlock()
+	for _, s := range c.values {
+		if s.vl.Plugin == "virt" && !c.staleness.expiration(&s.vl).Before(now) {
+			fresh[domainKey(s.vl.Host, s.vl.PluginInstance)] = true
+		}
+	}
+	for id, s := range c.values {
+		if c.staleness.expiration(&s.vl).Before(now) {
+			if s.vl.Plugin == "virt" {
+				key := domainKey(s.vl.Host, s.vl.PluginInstance)
+				if !fresh[key] && !stopped[key] {
+					log.Printf("Virt domain '%s' stopped reporting, purging its series", key)
+					stopped[key] = true
+				}
 			}
-			delete(c.values, id)
+			c.remove(id, s)
+			continue
+		}
+		instances[pluginInstanceOf(s.vl.Identifier)] = true
+		if interval := s.vl.Interval; interval > 0 && (smallest == 0 || interval < smallest) {
+			smallest = interval
+		}
+	}
+	for key, stop := range c.stopped {
+		if now.Sub(stop) > stoppedDomainRetention {
+			delete(c.stopped, key)
 		}
 	}
-	c.rw.Unlock()
+	c.notifications.expire(now, func(id api.Identifier) bool {
+		return instances[pluginInstanceOf(id)]
+	})
+	return smallest
 }
 
-func (c Collector) Write(_ context.Context, vl *api.ValueList) error {
+// pluginInstanceOf returns id without its type and type instance.
+func pluginInstanceOf(id api.Identifier) api.Identifier {
+	return api.Identifier{Host: id.Host, Plugin: id.Plugin, PluginInstance: id.PluginInstance}
+}
+
+// purgeDomain drops at once all the series of a stopped virt domain,
+// instead of waiting for them to expire, and rejects the samples taken
+// before the stop still on their way.
+func (c *Collector) purgeDomain(key string, stop time.Time) {
+	if stop.IsZero() {
+		stop = time.Now()
+	}
+	log.Printf("Virt domain '%s' stopped, purging its series", key)
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	c.stopped[key] = stop
+	for id, s := range c.values {
+		if s.vl.Plugin == "virt" && domainKey(s.vl.Host, s.vl.PluginInstance) == key {
+			c.remove(id, s)
+		}
+	}
+}
+
+// remove drops a series; c.rw must be held.
+func (c *Collector) remove(id string, s sample) {
+	if c.debugLog != nil {
+		c.debugLog.Printf("Purging: %s", id)
+	}
+	delete(c.values, id)
+	delete(c.conflicts, id)
+	c.conv.Forget(s.vl)
+	c.store.purged.Inc()
+}
+
+func (c *Collector) Write(ctx context.Context, vl *api.ValueList) error {
+	return c.write("direct", senderOf(ctx), vl, nil)
+}
+
+func (c *Collector) write(source, sender string, vl *api.ValueList, meta nameconv.Meta) error {
 	if c.debugLog != nil {
 		log.Printf("Writing: %s", vl.Identifier.String())
 	}
-	c.ch <- *vl
+	if err := checkIdentifier(vl.Identifier); err != nil {
+		log.Printf("Value list from %s rejected: %s", source, err)
+		return err
+	}
+	if c.relaySources[source] {
+		for _, r := range c.relays {
+			r.write(vl)
+		}
+	}
+	if c.recorder != nil {
+		if err := c.recorder.record(source, sender, vl, meta); err != nil {
+			log.Printf("Recording %s failed: %s", vl.Identifier.String(), err)
+		}
+	}
+	return c.queue.put(sample{vl: *vl, meta: meta, source: source, sender: sender})
+}
+
+func (c *Collector) notify(source string, n *notification) error {
+	if c.debugLog != nil {
+		c.debugLog.Printf("Notification from %s: %s %s: %s", source, n.Identifier.String(), n.Severity, n.Message)
+	}
+	if err := checkIdentifier(n.Identifier); err != nil {
+		log.Printf("Notification from %s rejected: %s", source, err)
+		return err
+	}
+	c.notifications.add(*n)
+	if key, ok := stoppedDomain(n); ok {
+		c.purgeDomain(key, n.Time)
+	}
+	return nil
+}
+
+// checkIdentifier fails if a field of id is not valid UTF-8, which the
+// label values must be.
+func checkIdentifier(id api.Identifier) error {
+	for _, s := range []string{id.Host, id.Plugin, id.PluginInstance, id.Type, id.TypeInstance} {
+		if !utf8.ValidString(s) {
+			return fmt.Errorf("Invalid identifier %q: not valid UTF-8", id.String())
+		}
+	}
 	return nil
 }
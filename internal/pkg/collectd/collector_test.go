@@ -0,0 +1,159 @@
+package collectd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func storeSample(secs int64, value float64, sender string) sample {
+	return sample{
+		vl: api.ValueList{
+			Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+			Time:       time.Unix(secs, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(value)},
+		},
+		source: "binary",
+		sender: sender,
+	}
+}
+
+func TestUpdateOrdering(t *testing.T) {
+	c := NewCollector(Config{})
+	c.conf.DetectConflicts = true
+	id := storeSample(0, 0, "").vl.Identifier.String()
+
+	for _, tc := range []struct {
+		name     string
+		s        sample
+		expected float64
+	}{
+		{"first", storeSample(1500000010, 1, "192.0.2.1:25826"), 1},
+		{"newer", storeSample(1500000020, 2, "192.0.2.1:25826"), 2},
+		{"out of order", storeSample(1500000010, 3, "192.0.2.1:25826"), 2},
+		{"duplicate", storeSample(1500000020, 2, "192.0.2.1:25826"), 2},
+		{"conflicting", storeSample(1500000025, 4, "192.0.2.2:25826"), 4},
+		{"future", storeSample(time.Now().Add(time.Hour).Unix(), 5, "192.0.2.1:25826"), 4},
+		{"skewed", storeSample(time.Now().Add(maxClockSkew/2).Unix(), 6, "192.0.2.1:25826"), 6},
+	} {
+		c.update(tc.s)
+		if got := float64(c.values[id].vl.Values[0].(api.Gauge)); got != tc.expected {
+			t.Errorf("%s: got %v, expected %v", tc.name, got, tc.expected)
+		}
+	}
+
+	for reason, expected := range map[string]float64{storeOutOfOrder: 1, storeDuplicate: 1, storeFuture: 1} {
+		if n := testutil.ToFloat64(c.store.rejected.WithLabelValues("host1", reason)); n != expected {
+			t.Errorf("got %v %s samples, expected %v", n, reason, expected)
+		}
+	}
+	if n := testutil.ToFloat64(c.store.conflicts.WithLabelValues("host1")); n != 1 {
+		t.Errorf("got %v conflicting samples, expected 1", n)
+	}
+	if !c.conflicts[id] {
+		t.Errorf("%s not flagged as conflicting", id)
+	}
+}
+
+func TestWriteInvalidIdentifier(t *testing.T) {
+	c := NewCollector(Config{})
+	vl := storeSample(1500000000, 1, "").vl
+	vl.Host = "host\xff"
+	if err := c.Write(context.Background(), &vl); err == nil {
+		t.Errorf("expected error with a host not valid UTF-8, got none")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	conf := Config{QueuePolicy: QueueBlock, StalenessPlugins: []string{"virt=4"}}
+	c := NewCollector(conf)
+	if err := c.Configure(conf); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	last := time.Unix(1500000000, 0)
+	for _, vl := range []api.ValueList{
+		{Identifier: api.Identifier{Host: "hv1", Plugin: "load", Type: "load"}, Interval: 10 * time.Second},
+		{Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom1", Type: "virt_cpu_total"}, Interval: 10 * time.Second},
+		{Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom2", Type: "virt_cpu_total"}, Interval: 6 * time.Second},
+		{Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom2", Type: "memory", TypeInstance: "total"}, Interval: 6 * time.Second},
+	} {
+		vl.Time = last
+		vl.Values = []api.Value{api.Gauge(1)}
+		c.update(sample{vl: vl, source: "binary"})
+	}
+
+	// load expires after 2 intervals, virt after 4
+	if smallest := c.purge(last.Add(22 * time.Second)); smallest != 6*time.Second {
+		t.Errorf("got smallest interval %s, expected 6s", smallest)
+	}
+	if len(c.values) != 3 {
+		t.Errorf("got %d series, expected the 3 virt ones", len(c.values))
+	}
+
+	c.notify("binary", &notification{
+		Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom2", Type: "domain_state"},
+		Time:       last.Add(time.Second),
+		Severity:   severityWarning,
+		Message:    "Domain state: the domain is shut off. Reason: normal shutdown",
+	})
+	if len(c.values) != 1 {
+		t.Errorf("got %d series, expected only the dom1 one", len(c.values))
+	}
+
+	// a late sample of the stopped domain is rejected, a restart is not
+	late := api.ValueList{
+		Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom2", Type: "virt_cpu_total"},
+		Time:       last,
+		Interval:   6 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	}
+	c.update(sample{vl: late, source: "binary"})
+	if len(c.values) != 1 {
+		t.Errorf("got %d series, expected the late sample rejected", len(c.values))
+	}
+	restarted := late
+	restarted.Time = last.Add(time.Minute)
+	c.update(sample{vl: restarted, source: "binary"})
+	if len(c.values) != 2 {
+		t.Errorf("got %d series, expected the restarted domain back", len(c.values))
+	}
+
+	// a detached disk of dom1 goes away alone, the domain keeps reporting
+	disk := api.ValueList{
+		Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom1", Type: "disk_octets", TypeInstance: "vdb"},
+		Time:       last,
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Derive(1), api.Derive(1)},
+	}
+	c.update(sample{vl: disk, source: "binary"})
+	cpu := api.ValueList{
+		Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom1", Type: "virt_cpu_total"},
+		Time:       last.Add(30 * time.Second),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	}
+	c.update(sample{vl: cpu, source: "binary"})
+	c.purge(last.Add(41 * time.Second))
+	if len(c.values) != 2 {
+		t.Errorf("got %d series, expected only the disk purged", len(c.values))
+	}
+	for _, id := range []api.Identifier{cpu.Identifier, restarted.Identifier} {
+		if _, ok := c.values[id.String()]; !ok {
+			t.Errorf("%s purged", id.String())
+		}
+	}
+	if _, ok := c.values[disk.Identifier.String()]; ok {
+		t.Errorf("%s not purged", disk.Identifier.String())
+	}
+
+	// once none of its series is fresh, the domain is gone
+	c.purge(last.Add(71 * time.Second))
+	if _, ok := c.values[cpu.Identifier.String()]; ok {
+		t.Errorf("%s not purged", cpu.Identifier.String())
+	}
+}
@@ -1,6 +1,10 @@
 package collectd
 
-import flag "github.com/spf13/pflag"
+import (
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
 
 type Config struct {
 	MetricsAddress         string
@@ -15,22 +19,116 @@ type Config struct {
 	DebugLog               bool
 	MetricsSource          string
 	MetricsPrefix          string
+	MappingFile            string
+	QueueSize              int
+	QueuePolicy            string
+	NotificationsSize      int
+	NotificationsGauge     bool
+	WebConfigFile          string
+	RecordFile             string
+	DetectConflicts        bool
+
+	CollectdBinaryListeners []string
+	CollectdRelays          []string
+
+	StalenessIntervals float64
+	StalenessPlugins   []string
+
+	ReplayFile     string
+	ReplaySpeed    float64
+	ReplayKeepTime bool
+
+	CollectdJSONTLSCertFile     string
+	CollectdJSONTLSKeyFile      string
+	CollectdJSONTLSClientCAFile string
+	CollectdJSONAuthFile        string
+	CollectdJSONTokensFile      string
+	CollectdJSONAuthzFile       string
+	CollectdJSONMaxBodySize     int64
+	CollectdJSONMaxValueLists   int
+	CollectdJSONCommandInterval time.Duration
+
+	CollectdGraphiteAddress         string
+	CollectdGraphitePrefix          string
+	CollectdGraphiteEscapeCharacter string
+	CollectdGraphiteInterval        time.Duration
+	CollectdGraphiteStoreRates      bool
+
+	CollectdInfluxDBURLPath    string
+	CollectdInfluxDBUDPAddress string
+	CollectdInfluxDBPrecision  string
+	CollectdInfluxDBInterval   time.Duration
+
+	CollectdUnixsockPath     string
+	CollectdUnixsockInterval time.Duration
+
+	CollectdScrapeURL      string
+	CollectdScrapeInterval time.Duration
 }
 
 func ConfigFromCommandLine() Config {
 	conf := Config{}
 	flag.StringVar(&conf.CollectdBinaryAddress, "collectd-bin-address", ":25826", "Network address on which to accept collectd network protocol pushes.")
+	flag.StringArrayVar(&conf.CollectdBinaryListeners, "collectd-bin-listener", nil, "Additional collectd network protocol listener: \"address[,source=label][,security-level=level][,auth-file=path][,recv-buffer-size=bytes][,interface=name]\". Can be repeated.")
+	flag.StringArrayVar(&conf.CollectdRelays, "collectd-relay", nil, "Upstream collectd server to relay the binary protocol and JSON pushes to: \"address[,security-level=level,username=user,auth-file=path][,host=pattern][,plugin=pattern][,buffer-packets=count]\". Can be repeated.")
 	flag.IntVar(&conf.CollectdRecvBufferSize, "collectd-bin-recv-buffer-size", 0, "Size of the buffer of the collectd network protocol receiver")
 	flag.StringVar(&conf.CollectdJSONAddress, "collectd-json-address", ":8103", "Network address on which to accept collectd JSON pushes.")
 	flag.StringVar(&conf.CollectdJSONURLPath, "collectd-json-url-path", "/collectd", "Collectd write_http URL path")
+	flag.StringVar(&conf.CollectdJSONTLSCertFile, "collectd-json-tls-cert-file", "", "Path of the TLS certificate of the collectd JSON endpoint. Enables HTTPS.")
+	flag.StringVar(&conf.CollectdJSONTLSKeyFile, "collectd-json-tls-key-file", "", "Path of the TLS key of the collectd JSON endpoint.")
+	flag.StringVar(&conf.CollectdJSONTLSClientCAFile, "collectd-json-tls-client-ca-file", "", "Path of the CA certificates the collectd JSON clients must present a certificate from.")
+	flag.StringVar(&conf.CollectdJSONAuthFile, "collectd-json-auth-file", "", "Path of the basic auth users of the collectd JSON endpoint, in the collectd auth file format (\"user: password\").")
+	flag.StringVar(&conf.CollectdJSONTokensFile, "collectd-json-tokens-file", "", "Path of the bearer tokens of the collectd JSON endpoint (\"identity: token\").")
+	flag.StringVar(&conf.CollectdJSONAuthzFile, "collectd-json-authz-file", "", "Path of the hosts each identity may report for on the collectd JSON endpoint (\"identity: pattern...\").")
+	flag.Int64Var(&conf.CollectdJSONMaxBodySize, "collectd-json-max-body-size", 10<<20, "Maximum size in bytes of a collectd HTTP push, once decompressed. 0 means no limit.")
+	flag.IntVar(&conf.CollectdJSONMaxValueLists, "collectd-json-max-value-lists", 0, "Maximum number of value lists in a collectd HTTP push. 0 means no limit.")
+	flag.DurationVar(&conf.CollectdJSONCommandInterval, "collectd-json-command-interval", 10*time.Second, "Collectd interval of the PUTVAL commands (write_http Format \"Command\") without the interval option.")
 	flag.StringVar(&conf.CollectdAuthPath, "collectd-auth-path", "", "Path of the collectd auth file")
 	flag.StringVar(&conf.CollectdSecurityLevel, "collectd-security-level", "None", "Security level for collectd inbound data (\"None\", \"Sign\" and \"Encrypt\").")
+	flag.StringVar(&conf.CollectdGraphiteAddress, "collectd-graphite-address", "", "Network address on which to accept collectd write_graphite pushes, over TCP and UDP.")
+	flag.StringVar(&conf.CollectdGraphitePrefix, "collectd-graphite-prefix", "collectd.", "Prefix of the metric paths, as set in collectd write_graphite.")
+	flag.StringVar(&conf.CollectdGraphiteEscapeCharacter, "collectd-graphite-escape-character", "", "Escape character, as set in collectd write_graphite, to turn back into dots in the host names. Alters the host names really containing it: empty to keep the host names as received.")
+	flag.DurationVar(&conf.CollectdGraphiteInterval, "collectd-graphite-interval", 10*time.Second, "Collectd interval, not carried by the graphite protocol.")
+	flag.BoolVar(&conf.CollectdGraphiteStoreRates, "collectd-graphite-store-rates", true, "Whether write_graphite sends rates (its StoreRates default) instead of the raw DERIVE and COUNTER values.")
+	flag.StringVar(&conf.CollectdInfluxDBURLPath, "collectd-influxdb-url-path", "/write", "Collectd write_http URL path for the INFLUXDB format, on the JSON endpoint. Empty to disable.")
+	flag.StringVar(&conf.CollectdInfluxDBUDPAddress, "collectd-influxdb-udp-address", "", "Network address on which to accept InfluxDB line protocol UDP pushes.")
+	flag.StringVar(&conf.CollectdInfluxDBPrecision, "collectd-influxdb-precision", "ms", "Default precision of the InfluxDB timestamps (\"ns\", \"us\", \"ms\", \"s\"), milliseconds as collectd write_http Format \"INFLUXDB\" sends.")
+	flag.DurationVar(&conf.CollectdInfluxDBInterval, "collectd-influxdb-interval", 10*time.Second, "Collectd interval, not carried by the InfluxDB line protocol.")
+	flag.StringVar(&conf.CollectdUnixsockPath, "collectd-unixsock-path", "", "Path of the collectd unixsock socket to poll for values.")
+	flag.DurationVar(&conf.CollectdUnixsockInterval, "collectd-unixsock-interval", 10*time.Second, "Poll interval of the collectd unixsock socket, should match the collectd interval.")
+	flag.StringVar(&conf.CollectdScrapeURL, "collectd-scrape-url", "", "URL of a collectd write_prometheus endpoint to scrape and remap.")
+	flag.DurationVar(&conf.CollectdScrapeInterval, "collectd-scrape-interval", 10*time.Second, "Scrape interval of the collectd write_prometheus endpoint, should match the collectd interval.")
 	flag.StringVar(&conf.CollectdTypesDBPath, "collectd-typesdb-path", "/usr/share/collectd/types.db", "Path to collectd types.db (needed for network protocol).")
 	flag.StringVar(&conf.MetricsAddress, "metrics-address", ":9103", "Address on which to expose metrics.")
 	flag.StringVar(&conf.MetricsURLPath, "metrics-url-path", "/metrics", "Prometheus metrics URL path.")
+	flag.StringVar(&conf.WebConfigFile, "web-config-file", "", "Path of the web configuration file (exporter-toolkit format) enabling TLS and basic auth on the metrics and collectd JSON endpoints. The collectd-json-tls-* and collectd-json-*-file flags override it on the collectd JSON endpoint.")
+	flag.IntVar(&conf.QueueSize, "queue-size", 1024, "Number of received value lists which can wait to be stored.")
+	flag.StringVar(&conf.QueuePolicy, "queue-policy", QueueBlock, "What to do when the queue is full (\"block\", \"drop-newest\" and \"drop-oldest\").")
+	flag.Float64Var(&conf.StalenessIntervals, "staleness-intervals", DefaultStalenessIntervals, "Number of intervals without values after which a series is dropped.")
+	flag.StringArrayVar(&conf.StalenessPlugins, "staleness-plugin", nil, "Staleness of the series of a plugin: \"plugin=intervals\". Can be repeated.")
+	flag.IntVar(&conf.NotificationsSize, "notifications-size", 100, "Number of collectd notifications kept for the /notifications endpoint.")
+	flag.BoolVar(&conf.NotificationsGauge, "notifications-gauge", false, "Expose the severity of the last notification of every identifier as a gauge.")
+	flag.BoolVar(&conf.DetectConflicts, "detect-conflicts", false, "Log and count the identifiers receiving conflicting values from different senders within one interval.")
+	flag.StringVar(&conf.RecordFile, "record-file", "", "Path of the file to append the received value lists to, for the replay subcommand.")
 	flag.BoolVar(&conf.DebugLog, "debug-log", false, "Enable verbose debug log.")
 	flag.StringVar(&conf.MetricsSource, "source", "virt", "Source identifier string.")
 	flag.StringVar(&conf.MetricsPrefix, "prefix", "vce", "Metrics name prefix.")
+	flag.StringVar(&conf.MappingFile, "mapping-file", "", "Path of the name mapping file (JSON, or YAML if ending in .yaml/.yml).")
 	flag.Parse()
 	return conf
 }
+
+// WithoutSources returns conf with all the data sources, the relays and
+// the recording disabled, for replaying a recording.
+func (conf Config) WithoutSources() Config {
+	conf.RecordFile = ""
+	conf.CollectdRelays = nil
+	conf.CollectdBinaryAddress = ""
+	conf.CollectdBinaryListeners = nil
+	conf.CollectdJSONAddress = ""
+	conf.CollectdGraphiteAddress = ""
+	conf.CollectdInfluxDBUDPAddress = ""
+	conf.CollectdUnixsockPath = ""
+	conf.CollectdScrapeURL = ""
+	return conf
+}
@@ -0,0 +1,181 @@
+package collectd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"collectd.org/api"
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
+)
+
+// Reasons for rejecting an entry of a push.
+const (
+	rejectMalformed         = "malformed"
+	rejectMissingIdentifier = "missing_identifier"
+	rejectNoValues          = "no_values"
+	rejectDSNamesMismatch   = "dsnames_mismatch"
+	rejectTypesDBMismatch   = "types_db_mismatch"
+	rejectBadNotification   = "bad_notification"
+	rejectWriteFailed       = "write_failed"
+)
+
+// rejectedEntry tells why an entry of a push was rejected. Index is the
+// position of the entry in the push, starting from 0.
+type rejectedEntry struct {
+	Index      int    `json:"index"`
+	Identifier string `json:"identifier,omitempty"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error"`
+}
+
+// pushResponse is the answer to a write_http JSON push.
+type pushResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected []rejectedEntry `json:"rejected,omitempty"`
+}
+
+// jsonPush is a decoded write_http JSON push. The meta data of the i-th
+// value list are meta[i], and its position in the push is index[i]; the
+// position of the i-th notification is notificationIndex[i].
+type jsonPush struct {
+	valueLists        []*api.ValueList
+	meta              []nameconv.Meta
+	index             []int
+	notifications     []*notification
+	notificationIndex []int
+	rejected          []rejectedEntry
+}
+
+// parseJSONPush decodes a write_http JSON push, which can mix value
+// lists and notifications. The entries which cannot be decoded or
+// are inconsistent are rejected one by one: only the errors affecting
+// the whole push are returned. The array is decoded one entry at a
+// time, and the decoding stops with errTooManyValueLists after
+// maxValueLists value lists, if it is positive.
+func parseJSONPush(r io.Reader, maxValueLists int, typesDB *api.TypesDB) (*jsonPush, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, errors.New("expected a JSON array")
+	}
+
+	push := &jsonPush{}
+	count := 0
+	for i := 0; dec.More(); i++ {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return nil, err
+		}
+
+		var jn jsonNotification
+		if err := json.Unmarshal(item, &jn); err == nil && jn.Labels != nil {
+			n, err := jn.notification()
+			if err != nil {
+				push.reject(i, "", rejectBadNotification, err)
+				continue
+			}
+			push.notifications = append(push.notifications, n)
+			push.notificationIndex = append(push.notificationIndex, i)
+			continue
+		}
+
+		count++
+		if maxValueLists > 0 && count > maxValueLists {
+			return nil, errTooManyValueLists
+		}
+		vl := &api.ValueList{}
+		if err := json.Unmarshal(item, vl); err != nil {
+			push.reject(i, "", rejectMalformed, err)
+			continue
+		}
+		if reason, err := validateJSONValueList(vl, item, typesDB); err != nil {
+			push.reject(i, vl.Identifier.String(), reason, err)
+			continue
+		}
+		m, err := parseJSONMeta(item)
+		if err != nil {
+			push.reject(i, vl.Identifier.String(), rejectMalformed, err)
+			continue
+		}
+		push.valueLists = append(push.valueLists, vl)
+		push.meta = append(push.meta, m)
+		push.index = append(push.index, i)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return push, nil
+}
+
+func (p *jsonPush) reject(index int, identifier, reason string, err error) {
+	p.rejected = append(p.rejected, rejectedEntry{
+		Index:      index,
+		Identifier: identifier,
+		Reason:     reason,
+		Error:      err.Error(),
+	})
+}
+
+// validateJSONValueList checks a value list decoded from item, returning
+// the reason for rejecting it if it is not consistent.
+func validateJSONValueList(vl *api.ValueList, item json.RawMessage, typesDB *api.TypesDB) (string, error) {
+	if vl.Host == "" || vl.Plugin == "" || vl.Type == "" {
+		return rejectMissingIdentifier, errors.New("host, plugin and type are required")
+	}
+	if len(vl.Values) == 0 {
+		return rejectNoValues, errors.New("no values")
+	}
+
+	// api.ValueList drops or truncates the mismatching dsnames
+	var names struct {
+		DSNames []string `json:"dsnames"`
+	}
+	if err := json.Unmarshal(item, &names); err != nil {
+		return rejectMalformed, err
+	}
+	if names.DSNames != nil && len(names.DSNames) != len(vl.Values) {
+		return rejectDSNamesMismatch, fmt.Errorf("%d value(s), %d data source name(s)", len(vl.Values), len(names.DSNames))
+	}
+
+	if typesDB != nil {
+		if ds, ok := typesDB.DataSet(vl.Type); ok && len(ds.Sources) != len(vl.Values) {
+			return rejectTypesDBMismatch, fmt.Errorf("%d value(s), %d data source(s) in types.db for '%s'", len(vl.Values), len(ds.Sources), vl.Type)
+		}
+	}
+	return "", nil
+}
+
+// parseJSONMeta decodes the "meta" object of a write_http JSON value
+// list, whose values can be strings, numbers or booleans.
+func parseJSONMeta(item json.RawMessage) (nameconv.Meta, error) {
+	var jm struct {
+		Meta map[string]interface{} `json:"meta"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(item))
+	dec.UseNumber()
+	if err := dec.Decode(&jm); err != nil {
+		return nil, err
+	}
+	if len(jm.Meta) == 0 {
+		return nil, nil
+	}
+	meta := make(nameconv.Meta, len(jm.Meta))
+	for k, v := range jm.Meta {
+		switch v := v.(type) {
+		case string:
+			meta[k] = v
+		case json.Number:
+			meta[k] = v.String()
+		case bool:
+			meta[k] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("meta '%s': unsupported value %v", k, v)
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,82 @@
+package collectd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
+)
+
+func TestParseJSONPush(t *testing.T) {
+	data := `[
+		{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1500000000,"interval":10,"host":"host1","plugin":"cpu","plugin_instance":"0","type":"percent","type_instance":"idle","meta":{"uuid":"c0ffee","vcpus":4,"active":true}},
+		{"labels":{"alertname":"collectd_virt","instance":"host1","service":"collectd","severity":"WARNING","plugin":"virt","plugin_instance":"dom1"},"annotations":{"summary":"domain paused"},"startsAt":"2017-07-14T02:40:00Z"}
+	]`
+	push, err := parseJSONPush(strings.NewReader(data), 0, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(push.valueLists) != 1 || push.valueLists[0].Plugin != "cpu" {
+		t.Errorf("got value lists %v", push.valueLists)
+	}
+	expectedMeta := []nameconv.Meta{{"uuid": "c0ffee", "vcpus": "4", "active": "true"}}
+	if !reflect.DeepEqual(push.meta, expectedMeta) {
+		t.Errorf("got meta %v, expected %v", push.meta, expectedMeta)
+	}
+	if len(push.notifications) != 1 {
+		t.Fatalf("got %d notifications, expected 1", len(push.notifications))
+	}
+	n := push.notifications[0]
+	if n.Host != "host1" || n.PluginInstance != "dom1" || n.Severity != severityWarning || n.Message != "domain paused" {
+		t.Errorf("got %+v", *n)
+	}
+
+	if _, err := parseJSONPush(strings.NewReader(data), 1, nil); err != nil {
+		t.Errorf("unexpected failure with a value list limit of 1: %s", err)
+	}
+	double := "[" + testJSONValueList + "," + testJSONValueList + "]"
+	if _, err := parseJSONPush(strings.NewReader(double), 1, nil); err != errTooManyValueLists {
+		t.Errorf("got %v, expected errTooManyValueLists", err)
+	}
+	if _, err := parseJSONPush(strings.NewReader(`{"values":[1]}`), 0, nil); err == nil {
+		t.Errorf("unexpected success for a JSON object")
+	}
+}
+
+func TestParseJSONPushRejections(t *testing.T) {
+	data := `[
+		{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"host":"host1","plugin":"load","type":"counter"},
+		{"values":[1],"dstypes":["gauge","gauge"],"host":"host1","plugin":"load","type":"counter"},
+		{"values":[],"dstypes":[],"host":"host1","plugin":"load","type":"counter"},
+		{"values":[1],"dstypes":["gauge"],"plugin":"load","type":"counter"},
+		{"values":[1,2],"dstypes":["gauge","gauge"],"dsnames":["value"],"host":"host1","plugin":"load","type":"counter"},
+		{"values":[1,2],"dstypes":["gauge","gauge"],"host":"host1","plugin":"load","type":"counter"},
+		{"labels":{"instance":"host1","severity":"bad"}}
+	]`
+	push, err := parseJSONPush(strings.NewReader(data), 0, newTestTypesDB(t))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(push.valueLists) != 1 || !reflect.DeepEqual(push.index, []int{0}) {
+		t.Errorf("got value lists %v at %v, expected only the first one", push.valueLists, push.index)
+	}
+	var got []string
+	for _, r := range push.rejected {
+		got = append(got, r.Reason)
+	}
+	expected := []string{
+		rejectMalformed,
+		rejectNoValues,
+		rejectMissingIdentifier,
+		rejectDSNamesMismatch,
+		rejectTypesDBMismatch,
+		rejectBadNotification,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got reasons %v, expected %v", got, expected)
+	}
+	if push.rejected[0].Index != 1 || push.rejected[5].Index != 6 {
+		t.Errorf("got rejections %+v", push.rejected)
+	}
+}
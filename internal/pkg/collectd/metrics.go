@@ -0,0 +1,225 @@
+package collectd
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ingestMetrics accounts for the data flowing through the data sources.
+type ingestMetrics struct {
+	received       *prometheus.CounterVec
+	decoded        *prometheus.CounterVec
+	decodeFailures *prometheus.CounterVec
+	authFailures   *prometheus.CounterVec
+	rejected       *prometheus.CounterVec
+}
+
+func newIngestMetrics() *ingestMetrics {
+	return &ingestMetrics{
+		received: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "received_pushes_total",
+				Help:      "Number of pushes (packets or requests) received, by source.",
+			},
+			[]string{"source"},
+		),
+		decoded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "decoded_value_lists_total",
+				Help:      "Number of value lists successfully decoded, by source.",
+			},
+			[]string{"source"},
+		),
+		decodeFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "decode_failures_total",
+				Help:      "Number of pushes which could not be decoded, by source.",
+			},
+			[]string{"source"},
+		),
+		authFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "auth_failures_total",
+				Help:      "Number of pushes rejected because of failed authentication, by source.",
+			},
+			[]string{"source"},
+		),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "rejected_entries_total",
+				Help:      "Number of value lists and notifications rejected from decoded pushes, by source and reason.",
+			},
+			[]string{"source", "reason"},
+		),
+	}
+}
+
+func (m *ingestMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.received.Describe(ch)
+	m.decoded.Describe(ch)
+	m.decodeFailures.Describe(ch)
+	m.authFailures.Describe(ch)
+	m.rejected.Describe(ch)
+}
+
+func (m *ingestMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.received.Collect(ch)
+	m.decoded.Collect(ch)
+	m.decodeFailures.Collect(ch)
+	m.authFailures.Collect(ch)
+	m.rejected.Collect(ch)
+}
+
+// Reasons for the store to reject a sample.
+const (
+	// storeOutOfOrder is a sample older than the stored one.
+	storeOutOfOrder = "out_of_order"
+	// storeDuplicate is a sample as old as the stored one.
+	storeDuplicate = "duplicate"
+	// storeFuture is a sample further in the future than maxClockSkew.
+	storeFuture = "future"
+)
+
+// storeMetrics accounts for the series kept by the Collector.
+type storeMetrics struct {
+	series             prometheus.GaugeFunc
+	purged             prometheus.Counter
+	conversionFailures prometheus.Counter
+	rejected           *prometheus.CounterVec
+	conflicts          *prometheus.CounterVec
+}
+
+func newStoreMetrics(c *Collector) *storeMetrics {
+	return &storeMetrics{
+		series: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: Name,
+				Name:      "series",
+				Help:      "Number of collectd value lists currently stored.",
+			},
+			func() float64 {
+				c.rw.RLock()
+				defer c.rw.RUnlock()
+				return float64(len(c.values))
+			},
+		),
+		purged: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "purged_series_total",
+				Help:      "Number of stored value lists purged because expired.",
+			},
+		),
+		conversionFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "conversion_failures_total",
+				Help:      "Number of values which could not be converted to prometheus metrics.",
+			},
+		),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "rejected_samples_total",
+				Help:      "Number of value lists not stored because not newer than the stored ones or in the future, by host and reason.",
+			},
+			[]string{"host", "reason"},
+		),
+		conflicts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "conflicting_samples_total",
+				Help:      "Number of value lists conflicting with the ones of another sender within one interval, by host.",
+			},
+			[]string{"host"},
+		),
+	}
+}
+
+func (m *storeMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.series.Describe(ch)
+	m.purged.Describe(ch)
+	m.conversionFailures.Describe(ch)
+	m.rejected.Describe(ch)
+	m.conflicts.Describe(ch)
+}
+
+func (m *storeMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.series.Collect(ch)
+	m.purged.Collect(ch)
+	m.conversionFailures.Collect(ch)
+	m.rejected.Collect(ch)
+	m.conflicts.Collect(ch)
+}
+
+// relayMetrics accounts for the value lists relayed upstream.
+type relayMetrics struct {
+	sent         *prometheus.CounterVec
+	dropped      *prometheus.CounterVec
+	sendFailures *prometheus.CounterVec
+	pending      *prometheus.GaugeVec
+}
+
+func newRelayMetrics() *relayMetrics {
+	return &relayMetrics{
+		sent: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "relay_sent_value_lists_total",
+				Help:      "Number of value lists sent to the upstream collectd servers, by upstream.",
+			},
+			[]string{"upstream"},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "relay_dropped_value_lists_total",
+				Help:      "Number of value lists dropped before reaching the upstream collectd servers, by upstream.",
+			},
+			[]string{"upstream"},
+		),
+		sendFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "relay_send_failures_total",
+				Help:      "Number of failed attempts to send to the upstream collectd servers, by upstream.",
+			},
+			[]string{"upstream"},
+		),
+		pending: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: Name,
+				Name:      "relay_pending_packets",
+				Help:      "Number of packets waiting to be sent to the upstream collectd servers, by upstream.",
+			},
+			[]string{"upstream"},
+		),
+	}
+}
+
+func (m *relayMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.sent.Describe(ch)
+	m.dropped.Describe(ch)
+	m.sendFailures.Describe(ch)
+	m.pending.Describe(ch)
+}
+
+func (m *relayMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.sent.Collect(ch)
+	m.dropped.Collect(ch)
+	m.sendFailures.Collect(ch)
+	m.pending.Collect(ch)
+}
+
+// isAuthError tells if err, returned by parseBinaryPacket, is caused by a
+// signature or encryption failure.
+func isAuthError(err error) bool {
+	var authErr *authError
+	return errors.As(err, &authErr)
+}
@@ -0,0 +1,242 @@
+package collectd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// severity of a notification, with the values of collectd's plugin.h.
+type severity int
+
+const (
+	severityFailure severity = 1
+	severityWarning severity = 2
+	severityOkay    severity = 4
+)
+
+func (s severity) String() string {
+	switch s {
+	case severityFailure:
+		return "failure"
+	case severityWarning:
+		return "warning"
+	case severityOkay:
+		return "okay"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+func (s severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func parseSeverity(s string) (severity, error) {
+	switch strings.ToLower(s) {
+	case "failure":
+		return severityFailure, nil
+	case "warning":
+		return severityWarning, nil
+	case "okay":
+		return severityOkay, nil
+	}
+	return 0, fmt.Errorf("Unknown severity: '%s'", s)
+}
+
+// notification is a collectd notification, as sent by the threshold
+// plugin or by plugins such as virt.
+type notification struct {
+	api.Identifier
+	Time     time.Time
+	Severity severity
+	Message  string
+}
+
+func (n notification) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Host           string    `json:"host"`
+		Plugin         string    `json:"plugin"`
+		PluginInstance string    `json:"plugin_instance,omitempty"`
+		Type           string    `json:"type,omitempty"`
+		TypeInstance   string    `json:"type_instance,omitempty"`
+		Time           time.Time `json:"time"`
+		Severity       severity  `json:"severity"`
+		Message        string    `json:"message"`
+	}{n.Host, n.Plugin, n.PluginInstance, n.Type, n.TypeInstance, n.Time, n.Severity, n.Message})
+}
+
+type notificationSink interface {
+	Notify(context.Context, *notification) error
+}
+
+// jsonNotification is the format of the notifications sent by collectd
+// write_http in JSON format, which follows the Alertmanager API.
+type jsonNotification struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+}
+
+func (j jsonNotification) notification() (*notification, error) {
+	sev, err := parseSeverity(j.Labels["severity"])
+	if err != nil {
+		return nil, err
+	}
+	n := &notification{
+		Identifier: api.Identifier{
+			Host:           j.Labels["instance"],
+			Plugin:         j.Labels["plugin"],
+			PluginInstance: j.Labels["plugin_instance"],
+			Type:           j.Labels["type"],
+			TypeInstance:   j.Labels["type_instance"],
+		},
+		Time:     j.StartsAt,
+		Severity: sev,
+		Message:  j.Annotations["summary"],
+	}
+	if n.Host == "" {
+		return nil, errors.New("notification without instance label")
+	}
+	return n, nil
+}
+
+// lastNotificationRetention is how long the severity of an identifier is
+// exported once no series of its plugin instance is stored anymore.
+const lastNotificationRetention = 10 * time.Minute
+
+// lastNotification is the last notification of an identifier, and when it
+// was received.
+type lastNotification struct {
+	notification
+	received time.Time
+}
+
+// notificationStore keeps the last notifications received, and accounts
+// for all of them.
+type notificationStore struct {
+	lock  sync.Mutex
+	ring  []notification
+	next  int
+	full  bool
+	last  map[api.Identifier]lastNotification
+	gauge bool
+
+	received *prometheus.CounterVec
+	severity *prometheus.Desc
+}
+
+// newNotificationStore creates a store keeping the last size notifications.
+// If gauge is true, the last severity of every identifier is exported.
+func newNotificationStore(size int, gauge bool) (*notificationStore, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("Invalid notifications size: %d", size)
+	}
+	return &notificationStore{
+		ring:  make([]notification, size),
+		last:  make(map[api.Identifier]lastNotification),
+		gauge: gauge,
+		received: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "notifications_total",
+				Help:      "Number of collectd notifications received, by severity and plugin.",
+			},
+			[]string{"severity", "plugin"},
+		),
+		severity: prometheus.NewDesc(
+			prometheus.BuildFQName(Name, "", "last_notification_severity"),
+			"Severity of the last collectd notification (1: failure, 2: warning, 4: okay).",
+			[]string{"host", "plugin", "plugin_instance", "type", "type_instance"},
+			nil,
+		),
+	}, nil
+}
+
+// add keeps n. Its identifier must have been checked with checkIdentifier,
+// the notifications with invalid label values being dropped.
+func (s *notificationStore) add(n notification) {
+	received, err := s.received.GetMetricWithLabelValues(n.Severity.String(), n.Plugin)
+	if err != nil {
+		log.Printf("Notification of %s dropped: %s", n.Identifier.String(), err)
+		return
+	}
+	received.Inc()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.ring) > 0 {
+		s.ring[s.next] = n
+		s.next = (s.next + 1) % len(s.ring)
+		if s.next == 0 {
+			s.full = true
+		}
+	}
+	if s.gauge {
+		s.last[n.Identifier] = lastNotification{n, time.Now()}
+	}
+}
+
+// expire forgets the severity of the identifiers received before
+// now - lastNotificationRetention, unless stored tells that series of
+// their host, plugin and plugin instance are still stored.
+func (s *notificationStore) expire(now time.Time, stored func(api.Identifier) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, n := range s.last {
+		if now.Sub(n.received) > lastNotificationRetention && !stored(id) {
+			delete(s.last, id)
+		}
+	}
+}
+
+// list returns the notifications kept, the oldest first.
+func (s *notificationStore) list() []notification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.full {
+		return append([]notification{}, s.ring[:s.next]...)
+	}
+	return append(append([]notification{}, s.ring[s.next:]...), s.ring[:s.next]...)
+}
+
+func (s *notificationStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(s.list())
+}
+
+func (s *notificationStore) Describe(ch chan<- *prometheus.Desc) {
+	s.received.Describe(ch)
+	if s.gauge {
+		ch <- s.severity
+	}
+}
+
+func (s *notificationStore) Collect(ch chan<- prometheus.Metric) {
+	s.received.Collect(ch)
+	if !s.gauge {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, n := range s.last {
+		m, err := prometheus.NewConstMetric(
+			s.severity, prometheus.GaugeValue, float64(n.Severity),
+			id.Host, id.Plugin, id.PluginInstance, id.Type, id.TypeInstance,
+		)
+		if err != nil {
+			// checked when received, should not happen
+			log.Printf("Notification severity of %s: %s", id.String(), err)
+			continue
+		}
+		ch <- m
+	}
+}
@@ -0,0 +1,284 @@
+package collectd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"collectd.org/api"
+	"collectd.org/cdtime"
+	"collectd.org/network"
+)
+
+// Binary protocol part types, see collectd's network.h. network.Parse
+// only decodes value lists, so the packets are decoded here, to get the
+// value lists and the notifications out of a single pass.
+const (
+	partHost           = 0x0000
+	partTime           = 0x0001
+	partPlugin         = 0x0002
+	partPluginInstance = 0x0003
+	partType           = 0x0004
+	partTypeInstance   = 0x0005
+	partValues         = 0x0006
+	partInterval       = 0x0007
+	partTimeHR         = 0x0008
+	partIntervalHR     = 0x0009
+	partMessage        = 0x0100
+	partSeverity       = 0x0101
+	partSignSHA256     = 0x0200
+	partEncryptAES256  = 0x0210
+)
+
+// Data source types of the values part.
+const (
+	dsTypeCounter = 0
+	dsTypeGauge   = 1
+	dsTypeDerive  = 2
+)
+
+// authError is a signature or encryption failure.
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string {
+	return e.err.Error()
+}
+
+// binaryPacket is the content of a binary protocol packet.
+type binaryPacket struct {
+	valueLists    []*api.ValueList
+	notifications []*notification
+}
+
+// binaryState is carried from part to part, as collectd only sends the
+// fields which changed.
+type binaryState struct {
+	vl       api.ValueList
+	severity severity
+}
+
+// parseBinaryPacket decodes the value lists and the notifications of a
+// binary protocol packet, honouring the signature and encryption like
+// network.Parse does: the data below opts.SecurityLevel is dropped. The
+// signature and encryption failures are authErrors.
+func parseBinaryPacket(b []byte, opts network.ParseOpts) (*binaryPacket, error) {
+	p := &binaryPacket{}
+	var state binaryState
+	if err := p.parse(b, network.None, &state, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *binaryPacket) parse(b []byte, level network.SecurityLevel, state *binaryState, opts network.ParseOpts) error {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errors.New("truncated part header")
+		}
+		kind := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if length < 5 || length > len(b) {
+			return fmt.Errorf("invalid part length %d", length)
+		}
+		payload, rest := b[4:length], b[length:]
+		b = rest
+
+		switch kind {
+		case partHost, partPlugin, partPluginInstance, partType, partTypeInstance, partMessage:
+			if payload[len(payload)-1] != 0 {
+				return errors.New("unterminated string part")
+			}
+			s := string(payload[:len(payload)-1])
+			if !utf8.ValidString(s) {
+				return errors.New("string part not valid UTF-8")
+			}
+			switch kind {
+			case partHost:
+				state.vl.Host = s
+			case partPlugin:
+				state.vl.Plugin = s
+			case partPluginInstance:
+				state.vl.PluginInstance = s
+			case partType:
+				state.vl.Type = s
+			case partTypeInstance:
+				state.vl.TypeInstance = s
+			case partMessage:
+				if opts.SecurityLevel <= level {
+					p.notifications = append(p.notifications, &notification{
+						Identifier: state.vl.Identifier,
+						Time:       state.vl.Time,
+						Severity:   state.severity,
+						Message:    s,
+					})
+				}
+			}
+
+		case partTime, partTimeHR, partInterval, partIntervalHR, partSeverity:
+			if len(payload) != 8 {
+				return errors.New("invalid numeric part")
+			}
+			v := binary.BigEndian.Uint64(payload)
+			switch kind {
+			case partTime:
+				state.vl.Time = time.Unix(int64(v), 0)
+			case partTimeHR:
+				state.vl.Time = cdtime.Time(v).Time()
+			case partInterval:
+				state.vl.Interval = time.Duration(v) * time.Second
+			case partIntervalHR:
+				state.vl.Interval = cdtime.Time(v).Duration()
+			case partSeverity:
+				state.severity = severity(v)
+			}
+
+		case partValues:
+			values, err := parseBinaryValues(payload)
+			if err != nil {
+				return err
+			}
+			vl := state.vl
+			vl.Values = values
+			if opts.TypesDB != nil {
+				if !setDataSources(&vl, opts.TypesDB) {
+					continue
+				}
+			}
+			if opts.SecurityLevel <= level {
+				p.valueLists = append(p.valueLists, &vl)
+			}
+
+		case partSignSHA256:
+			if err := verifyBinarySignature(payload, rest, opts.PasswordLookup); err != nil {
+				return &authError{err}
+			}
+			return p.parse(rest, network.Sign, state, opts)
+
+		case partEncryptAES256:
+			plaintext, err := decryptBinaryPart(payload, opts.PasswordLookup)
+			if err != nil {
+				return &authError{err}
+			}
+			// the encrypted parts start from a blank state
+			if err := p.parse(plaintext, network.Encrypt, &binaryState{}, opts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseBinaryValues(b []byte) ([]api.Value, error) {
+	if len(b) < 2 {
+		return nil, errors.New("invalid values part")
+	}
+	n := int(binary.BigEndian.Uint16(b[0:2]))
+	b = b[2:]
+	if len(b) != n*9 {
+		return nil, errors.New("invalid values part")
+	}
+	types, data := b[:n], b[n:]
+	values := make([]api.Value, n)
+	for i, typ := range types {
+		raw := data[i*8 : (i+1)*8]
+		switch typ {
+		case dsTypeGauge:
+			values[i] = api.Gauge(math.Float64frombits(binary.LittleEndian.Uint64(raw)))
+		case dsTypeDerive:
+			values[i] = api.Derive(int64(binary.BigEndian.Uint64(raw)))
+		case dsTypeCounter:
+			values[i] = api.Counter(binary.BigEndian.Uint64(raw))
+		default:
+			return nil, fmt.Errorf("unsupported data source type %d", typ)
+		}
+	}
+	return values, nil
+}
+
+// setDataSources converts the values of vl to the data source types of
+// typesDB, and sets the data source names. Like network.Parse, the value
+// lists not matching typesDB are skipped.
+func setDataSources(vl *api.ValueList, typesDB *api.TypesDB) bool {
+	ds, ok := typesDB.DataSet(vl.Type)
+	if !ok {
+		log.Printf("CollectD binary protocol: unknown type '%s'", vl.Type)
+		return false
+	}
+	values := make([]interface{}, len(vl.Values))
+	for i, v := range vl.Values {
+		values[i] = v
+	}
+	converted, err := ds.Values(values...)
+	if err != nil {
+		log.Printf("CollectD binary protocol: %s: %s", vl.Identifier.String(), err)
+		return false
+	}
+	vl.Values = converted
+	vl.DSNames = ds.Names()
+	return true
+}
+
+func verifyBinarySignature(part, payload []byte, lookup network.PasswordLookup) error {
+	if lookup == nil {
+		return errors.New("signed packet, but no password lookup available")
+	}
+	if len(part) <= sha256.Size {
+		return errors.New("signature part too small")
+	}
+	password, err := lookup.Password(string(part[sha256.Size:]))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(part[sha256.Size:])
+	mac.Write(payload)
+	if !hmac.Equal(part[:sha256.Size], mac.Sum(nil)) {
+		return errors.New("signature verification failure")
+	}
+	return nil
+}
+
+func decryptBinaryPart(part []byte, lookup network.PasswordLookup) ([]byte, error) {
+	if lookup == nil {
+		return nil, errors.New("encrypted packet, but no password lookup available")
+	}
+	if len(part) < 2 {
+		return nil, errors.New("encrypted part too small")
+	}
+	userLen := int(binary.BigEndian.Uint16(part[0:2]))
+	part = part[2:]
+	if userLen+aes.BlockSize+sha1.Size > len(part) {
+		return nil, errors.New("encrypted part too small")
+	}
+	password, err := lookup.Password(string(part[:userLen]))
+	if err != nil {
+		return nil, err
+	}
+	iv := part[userLen : userLen+aes.BlockSize]
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(part)-userLen-aes.BlockSize)
+	cipher.NewOFB(block, iv).XORKeyStream(plaintext, part[userLen+aes.BlockSize:])
+
+	checksum := sha1.Sum(plaintext[sha1.Size:])
+	if !bytes.Equal(checksum[:], plaintext[:sha1.Size]) {
+		return nil, errors.New("decrypt checksum mismatch")
+	}
+	return plaintext[sha1.Size:], nil
+}
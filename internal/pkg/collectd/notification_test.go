@@ -0,0 +1,212 @@
+package collectd
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testPasswordLookup map[string]string
+
+func (t testPasswordLookup) Password(user string) (string, error) {
+	if password, ok := t[user]; ok {
+		return password, nil
+	}
+	return "", fmt.Errorf("unknown user '%s'", user)
+}
+
+func appendStringPart(b []byte, kind uint16, s string) []byte {
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-4:], kind)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(4+len(s)+1))
+	return append(append(b, s...), 0)
+}
+
+func appendNumericPart(b []byte, kind uint16, v uint64) []byte {
+	b = append(b, make([]byte, 12)...)
+	binary.BigEndian.PutUint16(b[len(b)-12:], kind)
+	binary.BigEndian.PutUint16(b[len(b)-10:], 12)
+	binary.BigEndian.PutUint64(b[len(b)-8:], v)
+	return b
+}
+
+func TestParseBinaryNotifications(t *testing.T) {
+	var packet []byte
+	packet = appendStringPart(packet, partHost, "host1")
+	packet = appendNumericPart(packet, partTimeHR, uint64(1500000010)<<30|1<<29)
+	packet = appendStringPart(packet, partPlugin, "virt")
+	packet = appendStringPart(packet, partPluginInstance, "dom1")
+	packet = appendNumericPart(packet, partSeverity, uint64(severityFailure))
+	packet = appendStringPart(packet, partMessage, "domain stopped")
+	packet = appendStringPart(packet, partPluginInstance, "dom2")
+	packet = appendNumericPart(packet, partSeverity, uint64(severityOkay))
+	packet = appendStringPart(packet, partMessage, "domain started")
+
+	p, err := parseBinaryPacket(packet, network.ParseOpts{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	got := p.notifications
+	if len(got) != 2 {
+		t.Fatalf("got %d notifications, expected 2", len(got))
+	}
+	expected := notification{
+		Identifier: api.Identifier{Host: "host1", Plugin: "virt", PluginInstance: "dom1"},
+		Time:       time.Unix(1500000010, 500000000),
+		Severity:   severityFailure,
+		Message:    "domain stopped",
+	}
+	if *got[0] != expected {
+		t.Errorf("got %+v, expected %+v", *got[0], expected)
+	}
+	if got[1].PluginInstance != "dom2" || got[1].Severity != severityOkay {
+		t.Errorf("got %+v", *got[1])
+	}
+
+	// plain notifications are ignored when a security level is required
+	p, err = parseBinaryPacket(packet, network.ParseOpts{SecurityLevel: network.Sign})
+	if err != nil || len(p.notifications) != 0 {
+		t.Errorf("got %v, %v: expected no notifications", p, err)
+	}
+}
+
+func TestParseBinaryPacket(t *testing.T) {
+	lookup := testPasswordLookup{"alice": "secret"}
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)},
+	}
+
+	typesDB, err := api.NewTypesDB(strings.NewReader("load shortterm:GAUGE:0:U, midterm:GAUGE:0:U, longterm:GAUGE:0:U\n"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, level := range []network.SecurityLevel{network.None, network.Sign, network.Encrypt} {
+		buf := network.NewBuffer(network.DefaultBufferSize)
+		switch level {
+		case network.Sign:
+			buf.Sign("alice", "secret")
+		case network.Encrypt:
+			buf.Encrypt("alice", "secret")
+		}
+		if err := buf.Write(context.Background(), vl); err != nil {
+			t.Fatalf("%s", err)
+		}
+		packet, err := buf.Bytes()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		// the value lists must be decoded as network.Parse does
+		opts := network.ParseOpts{SecurityLevel: level, PasswordLookup: lookup, TypesDB: typesDB}
+		expected, err := network.Parse(packet, opts)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		p, err := parseBinaryPacket(packet, opts)
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		if len(p.notifications) != 0 {
+			t.Errorf("level %d: got %v: expected no notifications", level, p.notifications)
+		}
+		if !reflect.DeepEqual(p.valueLists, expected) {
+			t.Errorf("level %d: got %+v, expected %+v", level, p.valueLists, expected)
+		}
+
+		if level == network.None {
+			continue
+		}
+		opts.PasswordLookup = testPasswordLookup{"alice": "wrong"}
+		if _, err := parseBinaryPacket(packet, opts); !isAuthError(err) {
+			t.Errorf("level %d: got %v with the wrong password, expected an auth error", level, err)
+		}
+	}
+
+	buf := network.NewBuffer(network.DefaultBufferSize)
+	invalid := *vl
+	invalid.Host = "host\xff"
+	if err := buf.Write(context.Background(), &invalid); err != nil {
+		t.Fatalf("%s", err)
+	}
+	packet, err := buf.Bytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := parseBinaryPacket(packet, network.ParseOpts{TypesDB: typesDB}); err == nil {
+		t.Errorf("expected error with a host not valid UTF-8, got none")
+	}
+}
+
+func TestNotificationStore(t *testing.T) {
+	s, err := newNotificationStore(2, true)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for i, msg := range []string{"first", "second", "third"} {
+		s.add(notification{
+			Identifier: api.Identifier{Host: "host1", Plugin: "virt", PluginInstance: "dom1"},
+			Severity:   severity(1 << uint(i)),
+			Message:    msg,
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/notifications", nil))
+	var got []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(got) != 2 || got[0]["message"] != "second" || got[1]["message"] != "third" || got[1]["severity"] != "okay" {
+		t.Errorf("got %v", got)
+	}
+
+	if n := testutil.CollectAndCount(s, "virt_collectd_exporter_last_notification_severity"); n != 1 {
+		t.Errorf("got %d severity gauges, expected 1", n)
+	}
+
+	// the severity is kept while the plugin instance has series
+	later := time.Now().Add(2 * lastNotificationRetention)
+	s.expire(later, func(id api.Identifier) bool { return id.PluginInstance == "dom1" })
+	if n := testutil.CollectAndCount(s, "virt_collectd_exporter_last_notification_severity"); n != 1 {
+		t.Errorf("got %d severity gauges, expected 1 for the stored dom1", n)
+	}
+	s.expire(later, func(api.Identifier) bool { return false })
+	if n := testutil.CollectAndCount(s, "virt_collectd_exporter_last_notification_severity"); n != 0 {
+		t.Errorf("got %d severity gauges, expected the expired one dropped", n)
+	}
+	if n := testutil.ToFloat64(s.received.WithLabelValues("failure", "virt")); n != 1 {
+		t.Errorf("got %v failure notifications, expected 1", n)
+	}
+
+	// a label value which is not valid UTF-8 must not panic
+	s.add(notification{Identifier: api.Identifier{Host: "host1", Plugin: "p\xff"}, Severity: severityFailure})
+	if n := testutil.CollectAndCount(s, "virt_collectd_exporter_last_notification_severity"); n != 0 {
+		t.Errorf("got %d severity gauges, expected the invalid notification dropped", n)
+	}
+	conf := Config{QueuePolicy: QueueBlock, NotificationsGauge: true}
+	c := NewCollector(conf)
+	if err := c.Configure(conf); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := c.notify("binary", &notification{Identifier: api.Identifier{Host: "h\xff", Plugin: "virt"}}); err == nil {
+		t.Errorf("unexpected success for an invalid host")
+	}
+
+	if _, err := newNotificationStore(-1, false); err == nil {
+		t.Errorf("unexpected success for a negative size")
+	}
+}
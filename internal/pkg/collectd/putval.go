@@ -0,0 +1,181 @@
+package collectd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+)
+
+var (
+	gaugeType   = reflect.TypeOf(api.Gauge(0))
+	deriveType  = reflect.TypeOf(api.Derive(0))
+	counterType = reflect.TypeOf(api.Counter(0))
+)
+
+// parseCommands decodes the collectd plain text protocol, as sent by
+// write_http with Format "Command": one PUTVAL command per line. interval
+// is used for the commands without the interval option.
+func parseCommands(r io.Reader, typesDB *api.TypesDB, interval time.Duration, now time.Time) ([]*api.ValueList, error) {
+	var valueLists []*api.ValueList
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		vls, err := parsePutval(line, typesDB, interval, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		valueLists = append(valueLists, vls...)
+	}
+	return valueLists, scanner.Err()
+}
+
+// parsePutval decodes a single command line:
+//
+//	PUTVAL Identifier [OptionList] Valuelist [Valuelist...]
+//
+// Every Valuelist ("time:value[:value...]") yields a value list.
+func parsePutval(line string, typesDB *api.TypesDB, interval time.Duration, now time.Time) ([]*api.ValueList, error) {
+	fields, err := splitCommand(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 3 || !strings.EqualFold(fields[0], "PUTVAL") {
+		return nil, errors.New("expected: PUTVAL identifier [options] values")
+	}
+
+	id, err := api.ParseIdentifier(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if typesDB == nil {
+		return nil, errors.New("types.db is needed to decode PUTVAL")
+	}
+	ds, ok := typesDB.DataSet(id.Type)
+	if !ok {
+		return nil, fmt.Errorf("unknown type '%s'", id.Type)
+	}
+
+	var valueLists []*api.ValueList
+	for _, field := range fields[2:] {
+		if strings.Contains(field, "=") {
+			kv := strings.SplitN(field, "=", 2)
+			switch strings.ToLower(kv[0]) {
+			case "interval":
+				secs, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil || secs <= 0 {
+					return nil, fmt.Errorf("bad interval '%s'", kv[1])
+				}
+				interval = time.Duration(secs * float64(time.Second))
+			}
+			// unknown options are ignored, like collectd does
+			continue
+		}
+
+		vl, err := parsePutvalValues(field, ds, now)
+		if err != nil {
+			return nil, err
+		}
+		vl.Identifier = id
+		vl.Interval = interval
+		valueLists = append(valueLists, vl)
+	}
+	if len(valueLists) == 0 {
+		return nil, errors.New("missing values")
+	}
+	return valueLists, nil
+}
+
+func parsePutvalValues(field string, ds *api.DataSet, now time.Time) (*api.ValueList, error) {
+	items := strings.Split(field, ":")
+	if len(items)-1 != len(ds.Sources) {
+		return nil, fmt.Errorf("type '%s' expects %d values, got %d", ds.Name, len(ds.Sources), len(items)-1)
+	}
+
+	vl := &api.ValueList{}
+	if items[0] == "N" {
+		vl.Time = now
+	} else {
+		secs, err := strconv.ParseFloat(items[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad time '%s'", items[0])
+		}
+		vl.Time = time.Unix(0, int64(secs*float64(time.Second)))
+	}
+
+	for i, src := range ds.Sources {
+		v, err := parsePutvalValue(items[i+1], src.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", src.Name, err)
+		}
+		vl.Values = append(vl.Values, v)
+		vl.DSNames = append(vl.DSNames, src.Name)
+	}
+	return vl, nil
+}
+
+func parsePutvalValue(s string, typ reflect.Type) (api.Value, error) {
+	switch typ {
+	case gaugeType:
+		if s == "U" {
+			return api.Gauge(math.NaN()), nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		return api.Gauge(v), err
+	case deriveType:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return api.Derive(v), err
+	case counterType:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return api.Counter(v), err
+	}
+	return nil, fmt.Errorf("unsupported data source type %v", typ)
+}
+
+// splitCommand splits line on blanks, honouring double quoted strings
+// with backslash escapes, like collectd's parse_string.
+func splitCommand(line string) ([]string, error) {
+	var fields []string
+	var cur strings.Builder
+	inQuotes, escaped, inField := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(r)
+			inField = true
+		}
+	}
+	if inQuotes || escaped {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inField {
+		fields = append(fields, cur.String())
+	}
+	return fields, nil
+}
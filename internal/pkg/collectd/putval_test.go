@@ -0,0 +1,98 @@
+package collectd
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+const testTypesDB = `
+load      shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000
+if_octets rx:DERIVE:0:U, tx:DERIVE:0:U
+counter   value:COUNTER:U:U
+`
+
+func newTestTypesDB(t *testing.T) *api.TypesDB {
+	typesDB, err := api.NewTypesDB(strings.NewReader(testTypesDB))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return typesDB
+}
+
+func TestParseCommands(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	input := "PUTVAL \"host 1/load/load\" interval=10.000 1500000010.500:0.1:0.2:U\r\n" +
+		"\r\n" +
+		"PUTVAL host2/interface-eth0/if_octets interval=20 N:100:200 1500000020:110:210\r\n"
+
+	got, err := parseCommands(strings.NewReader(input), newTestTypesDB(t), 0, now)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d value lists, expected 3", len(got))
+	}
+
+	load := got[0]
+	if load.Identifier != (api.Identifier{Host: "host 1", Plugin: "load", Type: "load"}) {
+		t.Errorf("identifier: got %v", load.Identifier)
+	}
+	if load.Interval != 10*time.Second || !load.Time.Equal(time.Unix(1500000010, 500000000)) {
+		t.Errorf("time/interval: got %v/%v", load.Time, load.Interval)
+	}
+	if !reflect.DeepEqual(load.DSNames, []string{"shortterm", "midterm", "longterm"}) {
+		t.Errorf("dsnames: got %v", load.DSNames)
+	}
+	if load.Values[0] != api.Gauge(0.1) || !math.IsNaN(float64(load.Values[2].(api.Gauge))) {
+		t.Errorf("values: got %v", load.Values)
+	}
+
+	iface := got[1]
+	expected := api.Identifier{Host: "host2", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}
+	if iface.Identifier != expected || !iface.Time.Equal(now) || iface.Interval != 20*time.Second {
+		t.Errorf("got %v at %v every %v", iface.Identifier, iface.Time, iface.Interval)
+	}
+	if !reflect.DeepEqual(iface.Values, []api.Value{api.Derive(100), api.Derive(200)}) {
+		t.Errorf("values: got %v", iface.Values)
+	}
+	if got[2].Values[1] != api.Derive(210) {
+		t.Errorf("values: got %v", got[2].Values)
+	}
+}
+
+func TestParseCommandsDefaultInterval(t *testing.T) {
+	got, err := parseCommands(strings.NewReader("PUTVAL host1/load/load N:1:2:3"), newTestTypesDB(t), 10*time.Second, time.Now())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(got) != 1 || got[0].Interval != 10*time.Second {
+		t.Errorf("got %+v, expected an interval of 10s", got)
+	}
+}
+
+func TestParseCommandsInvalid(t *testing.T) {
+	cases := []string{
+		"PUTVAL host/load/load",
+		"GETVAL host/load/load N:1:2:3",
+		"PUTVAL host/load/load N:1:2",
+		"PUTVAL host/load/load X:1:2:3",
+		"PUTVAL host/unknown/unknown N:1",
+		"PUTVAL host/if/if_octets N:1.5:2",
+		"PUTVAL host/c/counter N:-1",
+		"PUTVAL \"host/load/load N:1:2:3",
+		"PUTVAL host/load/load interval=-1 N:1:2:3",
+	}
+	for _, c := range cases {
+		if _, err := parseCommands(strings.NewReader(c), newTestTypesDB(t), 0, time.Now()); err == nil {
+			t.Errorf("%q: expected error, got none", c)
+		}
+	}
+	if _, err := parseCommands(strings.NewReader("PUTVAL h/load/load N:1:2:3"), nil, 0, time.Now()); err == nil {
+		t.Errorf("expected error without types.db, got none")
+	}
+}
@@ -0,0 +1,206 @@
+package collectd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"collectd.org/api"
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Queue policies, applied when a sample arrives and the queue is full.
+const (
+	// QueueBlock waits until there is room in the queue.
+	QueueBlock = "block"
+	// QueueDropNewest discards the incoming sample.
+	QueueDropNewest = "drop-newest"
+	// QueueDropOldest discards the oldest queued sample.
+	QueueDropOldest = "drop-oldest"
+)
+
+type sample struct {
+	vl     api.ValueList
+	meta   nameconv.Meta
+	source string
+	// sender is the address the value list came from, if known
+	sender string
+}
+
+// errQueueClosed is returned for the samples arriving after shutdown,
+// e.g. from the HTTP requests outliving the shutdown timeout.
+var errQueueClosed = errors.New("Sample queue closed")
+
+// sampleQueue sits between the data sources and the store.
+type sampleQueue struct {
+	ch       chan sample
+	policy   string
+	enqueued *prometheus.CounterVec
+	dropped  *prometheus.CounterVec
+	length   prometheus.GaugeFunc
+	capacity prometheus.Gauge
+
+	// lock guards closed: put holds it for reading while sending on ch
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newSampleQueue(size int, policy string) (*sampleQueue, error) {
+	policy = strings.ToLower(policy)
+	switch policy {
+	case QueueBlock, QueueDropNewest, QueueDropOldest:
+	default:
+		return nil, fmt.Errorf("Unknown queue policy: '%s'", policy)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("Invalid queue size: %d", size)
+	}
+	if size == 0 && policy != QueueBlock {
+		// nothing could ever be kept in the queue
+		return nil, fmt.Errorf("Invalid queue size: %d with policy '%s'", size, policy)
+	}
+
+	q := &sampleQueue{
+		ch:     make(chan sample, size),
+		policy: policy,
+		enqueued: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "queue_enqueued_samples_total",
+				Help:      "Number of value lists queued for storage, by source.",
+			},
+			[]string{"source"},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "queue_dropped_samples_total",
+				Help:      "Number of value lists dropped because the queue was full, by source.",
+			},
+			[]string{"source"},
+		),
+		capacity: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: Name,
+				Name:      "queue_capacity",
+				Help:      "Maximum number of value lists the queue can hold.",
+			},
+		),
+	}
+	q.length = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: Name,
+			Name:      "queue_length",
+			Help:      "Number of value lists waiting in the queue.",
+		},
+		func() float64 { return float64(len(q.ch)) },
+	)
+	q.capacity.Set(float64(size))
+	return q, nil
+}
+
+func (q *sampleQueue) put(s sample) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	switch q.policy {
+	case QueueDropNewest:
+		select {
+		case q.ch <- s:
+		default:
+			q.dropped.WithLabelValues(s.source).Inc()
+			return nil
+		}
+	case QueueDropOldest:
+		for done := false; !done; {
+			select {
+			case q.ch <- s:
+				done = true
+			default:
+				select {
+				case old := <-q.ch:
+					q.dropped.WithLabelValues(old.source).Inc()
+				default:
+				}
+			}
+		}
+	default:
+		q.ch <- s
+	}
+	q.enqueued.WithLabelValues(s.source).Inc()
+	return nil
+}
+
+// close makes put fail from now on. The samples already queued, or being
+// queued, are still delivered.
+func (q *sampleQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+func (q *sampleQueue) Describe(ch chan<- *prometheus.Desc) {
+	q.enqueued.Describe(ch)
+	q.dropped.Describe(ch)
+	q.length.Describe(ch)
+	q.capacity.Describe(ch)
+}
+
+func (q *sampleQueue) Collect(ch chan<- prometheus.Metric) {
+	q.enqueued.Collect(ch)
+	q.dropped.Collect(ch)
+	q.length.Collect(ch)
+	q.capacity.Collect(ch)
+}
+
+// sourceSink tags the value lists written by a data source with its
+// name, so the queue can account for them.
+type sourceSink struct {
+	c      *Collector
+	source string
+}
+
+func (s sourceSink) Write(ctx context.Context, vl *api.ValueList) error {
+	return s.c.write(s.source, senderOf(ctx), vl, nil)
+}
+
+func (s sourceSink) WriteMeta(ctx context.Context, vl *api.ValueList, meta nameconv.Meta) error {
+	return s.c.write(s.source, senderOf(ctx), vl, meta)
+}
+
+func (s sourceSink) Notify(_ context.Context, n *notification) error {
+	return s.c.notify(s.source, n)
+}
+
+type senderKey struct{}
+
+// withSender returns a context carrying the address of the sender of the
+// value lists written with it.
+func withSender(ctx context.Context, sender string) context.Context {
+	return context.WithValue(ctx, senderKey{}, sender)
+}
+
+// senderOf returns the sender address carried by ctx, if any.
+func senderOf(ctx context.Context) string {
+	sender, _ := ctx.Value(senderKey{}).(string)
+	return sender
+}
+
+// senderHost returns the host part of addr, for the connection oriented
+// protocols where the port changes from a connection to the next.
+func senderHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,79 @@
+package collectd
+
+import (
+	"testing"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func queueSample(host, source string) sample {
+	return sample{
+		vl: api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "load"},
+		},
+		source: source,
+	}
+}
+
+func TestSampleQueuePolicies(t *testing.T) {
+	cases := []struct {
+		policy   string
+		expected []string
+	}{
+		{QueueDropNewest, []string{"h0", "h1"}},
+		{QueueDropOldest, []string{"h2", "h3"}},
+	}
+
+	for _, c := range cases {
+		q, err := newSampleQueue(2, c.policy)
+		if err != nil {
+			t.Fatalf("%s: %s", c.policy, err)
+		}
+		for _, host := range []string{"h0", "h1", "h2", "h3"} {
+			q.put(queueSample(host, "test"))
+		}
+		q.close()
+
+		var got []string
+		for s := range q.ch {
+			got = append(got, s.vl.Host)
+		}
+		if len(got) != len(c.expected) || got[0] != c.expected[0] || got[1] != c.expected[1] {
+			t.Errorf("%s: got %v, expected %v", c.policy, got, c.expected)
+		}
+		if n := testutil.ToFloat64(q.dropped.WithLabelValues("test")); n != 2 {
+			t.Errorf("%s: dropped %v, expected 2", c.policy, n)
+		}
+	}
+}
+
+func TestSampleQueueClosed(t *testing.T) {
+	q, err := newSampleQueue(1, QueueBlock)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	q.close()
+	if err := q.put(queueSample("h0", "test")); err != errQueueClosed {
+		t.Errorf("put after close: got %v, expected %v", err, errQueueClosed)
+	}
+	// closing twice is harmless
+	q.close()
+}
+
+func TestSampleQueueInvalid(t *testing.T) {
+	if _, err := newSampleQueue(1, "drop-random"); err == nil {
+		t.Errorf("newSampleQueue: expected error for unknown policy, got none")
+	}
+	if _, err := newSampleQueue(-1, QueueBlock); err == nil {
+		t.Errorf("newSampleQueue: expected error for negative size, got none")
+	}
+	for _, policy := range []string{QueueDropNewest, QueueDropOldest} {
+		if _, err := newSampleQueue(0, policy); err == nil {
+			t.Errorf("newSampleQueue: expected error for size 0 with %s, got none", policy)
+		}
+	}
+	if _, err := newSampleQueue(0, QueueBlock); err != nil {
+		t.Errorf("newSampleQueue: unexpected error for size 0 with block: %s", err)
+	}
+}
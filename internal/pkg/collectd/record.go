@@ -0,0 +1,154 @@
+package collectd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// record is a value list received by the Collector, as stored in the
+// recordings: one JSON object per line, the value list being in the
+// collectd JSON format.
+type record struct {
+	Received  time.Time      `json:"received"`
+	Source    string         `json:"source"`
+	Sender    string         `json:"sender,omitempty"`
+	ValueList *api.ValueList `json:"value_list"`
+	Meta      nameconv.Meta  `json:"meta,omitempty"`
+}
+
+// recorder appends the value lists received to a recording.
+type recorder struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newRecorder(filename string) (*recorder, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Recording to: '%s'", filename)
+	return &recorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *recorder) record(source, sender string, vl *api.ValueList, meta nameconv.Meta) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.enc.Encode(record{
+		Received:  time.Now(),
+		Source:    source,
+		Sender:    sender,
+		ValueList: vl,
+		Meta:      meta,
+	})
+}
+
+func (r *recorder) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
+
+// replayCollector is the data source replaying a recording.
+type replayCollector struct {
+	filename string
+	speed    float64
+	keepTime bool
+	c        *Collector
+	// done is closed once the recording is replayed
+	done chan struct{}
+}
+
+func (r *replayCollector) Configure(conf Config) error {
+	if conf.ReplaySpeed < 0 {
+		return fmt.Errorf("Invalid replay speed: %v", conf.ReplaySpeed)
+	}
+	r.speed = conf.ReplaySpeed
+	r.keepTime = conf.ReplayKeepTime
+	return nil
+}
+
+func (r *replayCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (r *replayCollector) Collect(ch chan<- prometheus.Metric) {}
+
+func (r *replayCollector) Run(ctx context.Context) error {
+	defer close(r.done)
+	file, err := os.Open(r.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count, err := r.c.replay(ctx, file, r.speed, r.keepTime)
+	if err != nil && err != context.Canceled {
+		return fmt.Errorf("Replay failed after %d value lists: %s", count, err)
+	}
+	log.Printf("Replayed %d value lists", count)
+	return nil
+}
+
+// Replayed returns a channel closed once the recording of
+// Config.ReplayFile is replayed, or nil if there is none.
+func (c *Collector) Replayed() <-chan struct{} {
+	if c.replayer == nil {
+		return nil
+	}
+	return c.replayer.done
+}
+
+// replay feeds the value lists of a recording to the Collector, as if
+// they were received from their original source. The pauses between
+// them are the original ones divided by speed; with a speed of 0, there
+// are no pauses. Unless keepTime is true, the time of the value lists is
+// shifted by the time elapsed since they were recorded, so they are
+// not purged as stale. Stops once ctx is cancelled, and returns the
+// number of value lists replayed.
+func (c *Collector) replay(ctx context.Context, r io.Reader, speed float64, keepTime bool) (int, error) {
+	dec := json.NewDecoder(r)
+	var last time.Time
+	count := 0
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		if rec.ValueList == nil {
+			continue
+		}
+
+		if speed > 0 && !last.IsZero() && rec.Received.After(last) {
+			pause := time.Duration(float64(rec.Received.Sub(last)) / speed)
+			select {
+			case <-time.After(pause):
+			case <-ctx.Done():
+				return count, ctx.Err()
+			}
+		}
+		last = rec.Received
+
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		if !keepTime {
+			rec.ValueList.Time = rec.ValueList.Time.Add(time.Since(rec.Received))
+		}
+		if err := c.write(rec.Source, rec.Sender, rec.ValueList, rec.Meta); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
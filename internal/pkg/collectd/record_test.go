@@ -0,0 +1,100 @@
+package collectd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "recording.jsonl")
+
+	valueLists := []*api.ValueList{
+		{
+			Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+			Time:       time.Unix(1500000000, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)},
+			DSNames:    []string{"shortterm", "midterm", "longterm"},
+		},
+		{
+			Identifier: api.Identifier{Host: "host1", Plugin: "virt", PluginInstance: "dom1", Type: "if_octets"},
+			Time:       time.Unix(1500000010, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Derive(10), api.Derive(20)},
+			DSNames:    []string{"rx", "tx"},
+		},
+	}
+	meta := []nameconv.Meta{nil, {"uuid": "c0ffee"}}
+
+	rec, err := newRecorder(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sources := []string{"binary", "json"}
+	senders := []string{"192.0.2.1:41000", ""}
+	for i, vl := range valueLists {
+		if err := rec.record(sources[i], senders[i], vl, meta[i]); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if err := rec.close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	conf := Config{QueueSize: len(valueLists), QueuePolicy: QueueBlock}
+	c := NewCollector(conf)
+	if err := c.Configure(conf); err != nil {
+		t.Fatalf("%s", err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer file.Close()
+	count, err := c.replay(context.Background(), file, 0, true)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if count != len(valueLists) {
+		t.Fatalf("replayed %d value lists, expected %d", count, len(valueLists))
+	}
+	for i, vl := range valueLists {
+		s := <-c.queue.ch
+		if !reflect.DeepEqual(s.vl, *vl) || !reflect.DeepEqual(s.meta, meta[i]) || s.source != sources[i] || s.sender != senders[i] {
+			t.Errorf("got %+v, expected %+v from %s (%s) with %v", s, *vl, sources[i], senders[i], meta[i])
+		}
+	}
+
+	// replayed as a data source, until the collector stops
+	conf = Config{MetricsAddress: "127.0.0.1:0", QueueSize: 1, QueuePolicy: QueueBlock, ReplayFile: filename}
+	c = NewCollector(conf)
+	if err := c.Configure(conf); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	<-c.Replayed()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(c.values) != len(valueLists) {
+		t.Errorf("got %d series, expected %d", len(c.values), len(valueLists))
+	}
+}
@@ -0,0 +1,332 @@
+package collectd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+)
+
+const (
+	// relayFlushInterval is how often the partially filled packets are
+	// sent upstream.
+	relayFlushInterval = time.Second
+	// relayQueueSize is the number of value lists waiting to be encoded.
+	relayQueueSize = 1024
+	// relayMinBackoff and relayMaxBackoff bound the wait before sending
+	// again to an upstream which failed.
+	relayMinBackoff = time.Second
+	relayMaxBackoff = time.Minute
+)
+
+// relayUpstream is the configuration of an upstream collectd server.
+type relayUpstream struct {
+	address       string
+	securityLevel string
+	username      string
+	authPath      string
+	hosts         []string
+	plugins       []string
+	bufferPackets int
+}
+
+// parseRelayUpstream parses an upstream specification:
+//
+//	address[,option=value...]
+//
+// with the options "security-level", "username" and "auth-file" (where
+// the password of username is read from), "host" and "plugin" (glob
+// patterns of the value lists to relay, can be repeated) and
+// "buffer-packets" (number of packets kept while the upstream is
+// unreachable).
+func parseRelayUpstream(spec string) (relayUpstream, error) {
+	fields := strings.Split(spec, ",")
+	u := relayUpstream{
+		address:       strings.TrimSpace(fields[0]),
+		bufferPackets: 1000,
+	}
+	if u.address == "" {
+		return u, fmt.Errorf("Invalid relay upstream: '%s': missing address", spec)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return u, fmt.Errorf("Invalid relay upstream: '%s': expected option=value, got '%s'", spec, field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "security-level":
+			u.securityLevel = value
+		case "username":
+			u.username = value
+		case "auth-file":
+			u.authPath = value
+		case "host", "plugin":
+			if _, err := path.Match(value, ""); err != nil {
+				return u, fmt.Errorf("Invalid relay upstream: '%s': bad pattern '%s'", spec, value)
+			}
+			if key == "host" {
+				u.hosts = append(u.hosts, value)
+			} else {
+				u.plugins = append(u.plugins, value)
+			}
+		case "buffer-packets":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return u, fmt.Errorf("Invalid relay upstream: '%s': bad buffer-packets '%s'", spec, value)
+			}
+			u.bufferPackets = n
+		default:
+			return u, fmt.Errorf("Invalid relay upstream: '%s': unknown option '%s'", spec, key)
+		}
+	}
+	return u, nil
+}
+
+// matches tells if the value list identified by id is to be relayed.
+func (u relayUpstream) matches(id api.Identifier) bool {
+	return matchAny(u.hosts, id.Host) && matchAny(u.plugins, id.Plugin)
+}
+
+// matchAny tells if s matches any of the patterns, or if there are none.
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// relayPacket is an encoded packet waiting to be sent upstream.
+type relayPacket struct {
+	data       []byte
+	valueLists int
+}
+
+// relay forwards value lists to an upstream collectd server with the
+// binary protocol. The value lists are packed as collectd does, and the
+// packets are kept while the upstream is unreachable, up to
+// bufferPackets: beyond, the oldest ones are dropped.
+type relay struct {
+	upstream relayUpstream
+	ch       chan *api.ValueList
+	level    network.SecurityLevel
+	password atomic.Value // string
+	buffer   *network.Buffer
+	buffered int
+	pending  []relayPacket
+	conn     net.Conn
+	backoff  time.Duration
+	retryAt  time.Time
+	metrics  *relayMetrics
+}
+
+func newRelay(upstream relayUpstream, metrics *relayMetrics) *relay {
+	return &relay{
+		upstream: upstream,
+		ch:       make(chan *api.ValueList, relayQueueSize),
+		metrics:  metrics,
+	}
+}
+
+func (r *relay) Configure(conf Config) error {
+	var err error
+	r.level, err = parseSecurityLevel(r.upstream.securityLevel)
+	if err != nil {
+		return err
+	}
+	if r.level != network.None && (r.upstream.username == "" || r.upstream.authPath == "") {
+		return fmt.Errorf("Relay to '%s': security level '%s' needs username and auth-file", r.upstream.address, r.upstream.securityLevel)
+	}
+	password, err := r.loadPassword()
+	if err != nil {
+		return err
+	}
+	r.password.Store(password)
+	r.buffer = network.NewBuffer(network.DefaultBufferSize)
+	r.secure()
+	return nil
+}
+
+// PrepareReload re-reads the password from the auth file.
+func (r *relay) PrepareReload(conf Config) (func(), error) {
+	password, err := r.loadPassword()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		r.password.Store(password)
+	}, nil
+}
+
+// loadPassword reads the password of the upstream user from its auth
+// file, if the security level needs one.
+func (r *relay) loadPassword() (string, error) {
+	if r.level == network.None {
+		return "", nil
+	}
+	users, err := parseCredentialsFile(r.upstream.authPath)
+	if err != nil {
+		return "", err
+	}
+	password, ok := users[r.upstream.username]
+	if !ok {
+		return "", fmt.Errorf("Relay to '%s': user '%s' not found in '%s'", r.upstream.address, r.upstream.username, r.upstream.authPath)
+	}
+	return password, nil
+}
+
+// secure signs or encrypts the buffer with the current password. The
+// buffer is not safe for concurrent use, so this runs in the Run loop.
+func (r *relay) secure() {
+	switch r.level {
+	case network.Sign:
+		r.buffer.Sign(r.upstream.username, r.password.Load().(string))
+	case network.Encrypt:
+		r.buffer.Encrypt(r.upstream.username, r.password.Load().(string))
+	}
+}
+
+// write queues vl for the upstream, if it matches the filters. It never
+// blocks: if the queue is full, vl is dropped.
+func (r *relay) write(vl *api.ValueList) {
+	if !r.upstream.matches(vl.Identifier) {
+		return
+	}
+	copied := *vl
+	select {
+	case r.ch <- &copied:
+	default:
+		r.metrics.dropped.WithLabelValues(r.upstream.address).Inc()
+	}
+}
+
+// Run sends the queued value lists until ctx is done, then tries once to
+// send what is left.
+func (r *relay) Run(ctx context.Context) error {
+	log.Printf("CollectD relay to '%s': starting", r.upstream.address)
+	ticker := time.NewTicker(relayFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case vl := <-r.ch:
+			r.add(vl)
+		case <-ticker.C:
+			r.flush()
+			r.send()
+		case <-ctx.Done():
+			for len(r.ch) > 0 {
+				r.add(<-r.ch)
+			}
+			r.flush()
+			r.retryAt = time.Time{}
+			r.send()
+			if r.conn != nil {
+				r.conn.Close()
+			}
+			log.Printf("CollectD relay to '%s': stopped", r.upstream.address)
+			return nil
+		}
+	}
+}
+
+func (r *relay) add(vl *api.ValueList) {
+	err := r.buffer.Write(context.Background(), vl)
+	if err == network.ErrNotEnoughSpace {
+		r.flush()
+		err = r.buffer.Write(context.Background(), vl)
+	}
+	if err != nil {
+		r.metrics.dropped.WithLabelValues(r.upstream.address).Inc()
+		log.Printf("CollectD relay to '%s': cannot encode %s: %s", r.upstream.address, vl.Identifier.String(), err)
+		return
+	}
+	r.buffered++
+}
+
+// flush moves the buffered value lists to a pending packet.
+func (r *relay) flush() {
+	if r.buffered == 0 {
+		return
+	}
+	r.secure()
+	data, err := r.buffer.Bytes()
+	if err != nil {
+		r.metrics.dropped.WithLabelValues(r.upstream.address).Add(float64(r.buffered))
+		log.Printf("CollectD relay to '%s': cannot encode packet: %s", r.upstream.address, err)
+	} else {
+		r.pending = append(r.pending, relayPacket{data: data, valueLists: r.buffered})
+	}
+	r.buffered = 0
+
+	for len(r.pending) > r.upstream.bufferPackets {
+		r.metrics.dropped.WithLabelValues(r.upstream.address).Add(float64(r.pending[0].valueLists))
+		r.pending = r.pending[1:]
+	}
+	r.metrics.pending.WithLabelValues(r.upstream.address).Set(float64(len(r.pending)))
+}
+
+// send sends the pending packets, unless waiting after a failure.
+func (r *relay) send() {
+	if len(r.pending) == 0 || time.Now().Before(r.retryAt) {
+		return
+	}
+	for len(r.pending) > 0 {
+		err := r.dial()
+		if err == nil {
+			_, err = r.conn.Write(r.pending[0].data)
+		}
+		if err != nil {
+			r.failed(err)
+			return
+		}
+		r.metrics.sent.WithLabelValues(r.upstream.address).Add(float64(r.pending[0].valueLists))
+		r.pending = r.pending[1:]
+	}
+	r.metrics.pending.WithLabelValues(r.upstream.address).Set(0)
+	if r.backoff != 0 {
+		log.Printf("CollectD relay to '%s': upstream reachable again", r.upstream.address)
+		r.backoff = 0
+	}
+}
+
+func (r *relay) dial() error {
+	if r.conn != nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", r.upstream.address)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	return nil
+}
+
+// failed schedules the next attempt, with an exponential backoff. The
+// connection is dialled again, in case the upstream address changed.
+func (r *relay) failed(err error) {
+	r.metrics.sendFailures.WithLabelValues(r.upstream.address).Inc()
+	if r.backoff == 0 {
+		log.Printf("CollectD relay to '%s': upstream unreachable, buffering: %s", r.upstream.address, err)
+		r.backoff = relayMinBackoff
+	} else if r.backoff *= 2; r.backoff > relayMaxBackoff {
+		r.backoff = relayMaxBackoff
+	}
+	r.retryAt = time.Now().Add(r.backoff)
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
@@ -0,0 +1,255 @@
+package collectd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRelayUpstream(t *testing.T) {
+	got, err := parseRelayUpstream("collectd.example.com:25826,security-level=Sign,username=alice,auth-file=/etc/collectd/auth,host=hv-*,plugin=virt,plugin=load,buffer-packets=10")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := relayUpstream{
+		address:       "collectd.example.com:25826",
+		securityLevel: "Sign",
+		username:      "alice",
+		authPath:      "/etc/collectd/auth",
+		hosts:         []string{"hv-*"},
+		plugins:       []string{"virt", "load"},
+		bufferPackets: 10,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+
+	for _, id := range []struct {
+		id      api.Identifier
+		matches bool
+	}{
+		{api.Identifier{Host: "hv-1", Plugin: "virt"}, true},
+		{api.Identifier{Host: "hv-2", Plugin: "load"}, true},
+		{api.Identifier{Host: "hv-1", Plugin: "cpu"}, false},
+		{api.Identifier{Host: "db-1", Plugin: "virt"}, false},
+	} {
+		if got.matches(id.id) != id.matches {
+			t.Errorf("%s: expected match %v", id.id.String(), id.matches)
+		}
+	}
+
+	invalid := []string{
+		"",
+		",host=hv-1",
+		"127.0.0.1:25826,host",
+		"127.0.0.1:25826,host=[",
+		"127.0.0.1:25826,buffer-packets=-1",
+		"127.0.0.1:25826,colour=blue",
+	}
+	for _, spec := range invalid {
+		if _, err := parseRelayUpstream(spec); err == nil {
+			t.Errorf("%q: unexpected success", spec)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	authPath := writeTestFile(t, dir, "auth", "alice: secret\n")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	upstream, err := parseRelayUpstream(conn.LocalAddr().String() + ",security-level=Sign,username=alice,auth-file=" + authPath + ",plugin=load")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	r := newRelay(upstream, newRelayMetrics())
+	if err := r.Configure(Config{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	relayed := &api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)},
+	}
+	filtered := &api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "cpu", TypeInstance: "idle", Type: "cpu"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Derive(42)},
+	}
+	r.write(relayed)
+	r.write(filtered)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.Run(ctx)
+	}()
+	cancel()
+	wg.Wait()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, network.DefaultBufferSize)
+	n, _, err := conn.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	got, err := network.Parse(packet[:n], network.ParseOpts{
+		PasswordLookup: network.NewAuthFile(authPath),
+		SecurityLevel:  network.Sign,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(got) != 1 || got[0].Identifier != relayed.Identifier || !reflect.DeepEqual(got[0].Values, relayed.Values) {
+		t.Errorf("got %+v, expected only %+v", got, relayed)
+	}
+	if n := testutil.ToFloat64(r.metrics.sent.WithLabelValues(upstream.address)); n != 1 {
+		t.Errorf("got %v sent value lists, expected 1", n)
+	}
+}
+
+func TestRelayReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	authPath := writeTestFile(t, dir, "auth", "alice: secret\n")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	upstream, err := parseRelayUpstream(conn.LocalAddr().String() + ",security-level=Encrypt,username=alice,auth-file=" + authPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	r := newRelay(upstream, newRelayMetrics())
+	if err := r.Configure(Config{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	writeTestFile(t, dir, "auth", "alice: changed\n")
+	commit, err := r.PrepareReload(Config{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	commit()
+
+	r.add(&api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)},
+	})
+	r.flush()
+	r.send()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, network.DefaultBufferSize)
+	n, _, err := conn.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	got, err := network.Parse(packet[:n], network.ParseOpts{
+		PasswordLookup: testPasswordLookup{"alice": "changed"},
+		SecurityLevel:  network.Encrypt,
+	})
+	if err != nil || len(got) != 1 {
+		t.Errorf("got %v, %v: expected the value list encrypted with the new password", got, err)
+	}
+
+	writeTestFile(t, dir, "auth", "bob: secret\n")
+	if _, err := r.PrepareReload(Config{}); err == nil {
+		t.Errorf("unexpected success without the user")
+	}
+}
+
+func TestRelaySendFailure(t *testing.T) {
+	upstream, err := parseRelayUpstream("127.0.0.1:99999")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	r := newRelay(upstream, newRelayMetrics())
+	if err := r.Configure(Config{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// the packet is kept for the next attempt
+	r.add(&api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0)},
+	})
+	r.flush()
+	r.send()
+	if len(r.pending) != 1 {
+		t.Errorf("got %d pending packets, expected 1", len(r.pending))
+	}
+	if n := testutil.ToFloat64(r.metrics.sendFailures.WithLabelValues(upstream.address)); n != 1 {
+		t.Errorf("got %v send failures, expected 1", n)
+	}
+	if !r.retryAt.After(time.Now()) {
+		t.Errorf("no backoff after the failure")
+	}
+}
+
+func TestRelayBuffering(t *testing.T) {
+	upstream, err := parseRelayUpstream("127.0.0.1:25826,buffer-packets=2")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	r := newRelay(upstream, newRelayMetrics())
+	if err := r.Configure(Config{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// as if the upstream failed: nothing is sent until retryAt
+	r.failed(errors.New("connection refused"))
+
+	for i := 0; i < 3; i++ {
+		r.add(&api.ValueList{
+			Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+			Time:       time.Unix(int64(1500000000+i*10), 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(float64(i))},
+		})
+		r.flush()
+		r.send()
+	}
+	if len(r.pending) != 2 {
+		t.Errorf("got %d pending packets, expected 2", len(r.pending))
+	}
+	if n := testutil.ToFloat64(r.metrics.dropped.WithLabelValues(upstream.address)); n != 1 {
+		t.Errorf("got %v dropped value lists, expected 1", n)
+	}
+	if n := testutil.ToFloat64(r.metrics.pending.WithLabelValues(upstream.address)); n != 2 {
+		t.Errorf("got %v pending packets, expected 2", n)
+	}
+}
@@ -0,0 +1,130 @@
+package collectd
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type reloadMetrics struct {
+	success     prometheus.Gauge
+	successTime prometheus.Gauge
+	failures    prometheus.Counter
+}
+
+func newReloadMetrics() *reloadMetrics {
+	return &reloadMetrics{
+		success: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: Name,
+				Name:      "config_last_reload_successful",
+				Help:      "Whether the last configuration reload attempt was successful.",
+			},
+		),
+		successTime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: Name,
+				Name:      "config_last_reload_success_timestamp_seconds",
+				Help:      "Unix timestamp of the last successful configuration reload in seconds.",
+			},
+		),
+		failures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: Name,
+				Name:      "config_reload_failures_total",
+				Help:      "Number of failed configuration reload attempts.",
+			},
+		),
+	}
+}
+
+func (r *reloadMetrics) succeeded() {
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+}
+
+func (r *reloadMetrics) failed() {
+	r.success.Set(0)
+	r.failures.Inc()
+}
+
+func (r *reloadMetrics) Describe(ch chan<- *prometheus.Desc) {
+	r.success.Describe(ch)
+	r.successTime.Describe(ch)
+	r.failures.Describe(ch)
+}
+
+func (r *reloadMetrics) Collect(ch chan<- prometheus.Metric) {
+	r.success.Collect(ch)
+	r.successTime.Collect(ch)
+	r.failures.Collect(ch)
+}
+
+// Reload re-reads the mapping file, types.db, the auth files and the web
+// config file. If any of them fails to load, the running configuration is
+// left untouched.
+func (c *Collector) Reload() error {
+	// a reload must not commit between the prepare and commit phases of
+	// another one, or their files would end up mixed
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	start := time.Now()
+	log.Printf("Reloading configuration")
+
+	conv, err := loadNameConverter(c.conf)
+	if err != nil {
+		return c.reloadFailed(err)
+	}
+
+	var commits []func()
+	for _, src := range c.srcs {
+		r, ok := src.(reloadableCollector)
+		if !ok {
+			continue
+		}
+		commit, err := r.PrepareReload(c.conf)
+		if err != nil {
+			return c.reloadFailed(err)
+		}
+		commits = append(commits, commit)
+	}
+	for _, r := range c.relays {
+		commit, err := r.PrepareReload(c.conf)
+		if err != nil {
+			return c.reloadFailed(err)
+		}
+		commits = append(commits, commit)
+	}
+
+	web, err := loadWebConfig(c.conf.WebConfigFile)
+	if err != nil {
+		return c.reloadFailed(err)
+	}
+
+	c.rw.Lock()
+	c.conv = conv
+	c.web.Store(web)
+	for _, commit := range commits {
+		commit()
+	}
+	c.rw.Unlock()
+
+	c.reload.succeeded()
+	log.Printf("Configuration reloaded in %s", time.Since(start))
+	return nil
+}
+
+func (c *Collector) reloadFailed(err error) error {
+	c.reload.failed()
+	log.Printf("Configuration reload failed, keeping the current one: %s", err)
+	return err
+}
+
+func (c *Collector) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := c.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
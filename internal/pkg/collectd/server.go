@@ -0,0 +1,42 @@
+package collectd
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ShutdownTimeout is how long the HTTP servers wait for the in-flight
+// requests to complete on shutdown.
+const ShutdownTimeout = 10 * time.Second
+
+// runHTTPServer serves srv until ctx is done, then shuts it down
+// gracefully. Returns nil after a clean shutdown. If srv has a TLS
+// configuration, it serves HTTPS.
+func runHTTPServer(ctx context.Context, srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificates are in the TLS configuration
+			errc <- srv.ListenAndServeTLS("", "")
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -2,107 +2,302 @@ package collectd
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"collectd.org/api"
 	"collectd.org/network"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type binaryProtoCollector struct {
-	address    string
-	srv        *network.Server
-	lastUpdate prometheus.Gauge
+// maxPacketSize is the largest UDP payload collectd can send.
+const maxPacketSize = 65535
+
+// binaryListener is the configuration of a binary protocol listener.
+// The source labels the data it receives in the exporter metrics.
+type binaryListener struct {
+	address        string
+	iface          string
+	securityLevel  string
+	authPath       string
+	recvBufferSize int
+	source         string
 }
 
-func (b *binaryProtoCollector) configureTypesDB(conf Config) error {
-	if conf.CollectdTypesDBPath != "" {
-		file, err := os.Open(conf.CollectdTypesDBPath)
+// binaryListeners returns the binary protocol listeners to start: the one
+// configured by --collectd-bin-address, if any, and the ones configured by
+// --collectd-bin-listener.
+func binaryListeners(conf Config) ([]binaryListener, error) {
+	var listeners []binaryListener
+	if conf.CollectdBinaryAddress != "" {
+		listeners = append(listeners, binaryListener{
+			address:        conf.CollectdBinaryAddress,
+			securityLevel:  conf.CollectdSecurityLevel,
+			authPath:       conf.CollectdAuthPath,
+			recvBufferSize: conf.CollectdRecvBufferSize,
+			source:         "binary",
+		})
+	}
+	sources := make(map[string]bool)
+	for _, l := range listeners {
+		sources[l.source] = true
+	}
+	for _, spec := range conf.CollectdBinaryListeners {
+		l, err := parseBinaryListener(spec, conf)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer file.Close()
+		if sources[l.source] {
+			return nil, fmt.Errorf("Duplicate binary listener source: '%s'", l.source)
+		}
+		sources[l.source] = true
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
 
-		typesDB, err := api.NewTypesDB(file)
-		if err != nil {
-			return err
+// parseBinaryListener parses a listener specification:
+//
+//	address[,option=value...]
+//
+// with the options "source", "security-level", "auth-file",
+// "recv-buffer-size" and "interface" (of a multicast address). The
+// options not given default to the global settings.
+func parseBinaryListener(spec string, conf Config) (binaryListener, error) {
+	fields := strings.Split(spec, ",")
+	l := binaryListener{
+		address:        strings.TrimSpace(fields[0]),
+		securityLevel:  conf.CollectdSecurityLevel,
+		authPath:       conf.CollectdAuthPath,
+		recvBufferSize: conf.CollectdRecvBufferSize,
+	}
+	if l.address == "" {
+		return l, fmt.Errorf("Invalid binary listener: '%s': missing address", spec)
+	}
+	l.source = "binary:" + l.address
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("Invalid binary listener: '%s': expected option=value, got '%s'", spec, field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "source":
+			l.source = value
+		case "security-level":
+			l.securityLevel = value
+		case "auth-file":
+			l.authPath = value
+		case "recv-buffer-size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return l, fmt.Errorf("Invalid binary listener: '%s': %s", spec, err)
+			}
+			l.recvBufferSize = size
+		case "interface":
+			l.iface = value
+		default:
+			return l, fmt.Errorf("Invalid binary listener: '%s': unknown option '%s'", spec, key)
 		}
-		b.srv.TypesDB = typesDB
-		log.Printf("CollectD types.db: '%s'", conf.CollectdTypesDBPath)
 	}
-	return nil
+	if _, err := parseSecurityLevel(l.securityLevel); err != nil {
+		return l, fmt.Errorf("Invalid binary listener: '%s': %s", spec, err)
+	}
+	return l, nil
 }
 
-func (b *binaryProtoCollector) configureSecurity(conf Config) error {
-	if conf.CollectdAuthPath != "" {
-		b.srv.PasswordLookup = network.NewAuthFile(conf.CollectdAuthPath)
-		log.Printf("CollectD auth file: '%s'", conf.CollectdAuthPath)
+type binaryProtoCollector struct {
+	listener   binaryListener
+	conn       *net.UDPConn
+	sink       dataSink
+	notifier   notificationSink
+	opts       atomic.Value // network.ParseOpts
+	metrics    *ingestMetrics
+	lastUpdate prometheus.Gauge
+}
+
+func loadTypesDB(conf Config) (*api.TypesDB, error) {
+	if conf.CollectdTypesDBPath == "" {
+		return nil, nil
 	}
+	file, err := os.Open(conf.CollectdTypesDBPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	typesDB, err := api.NewTypesDB(file)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("CollectD types.db: '%s'", conf.CollectdTypesDBPath)
+	return typesDB, nil
+}
+
+func loadPasswordLookup(authPath string) (network.PasswordLookup, error) {
+	if authPath == "" {
+		return nil, nil
+	}
+	// AuthFile reads the file lazily: make sure it is there now.
+	file, err := os.Open(authPath)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	log.Printf("CollectD auth file: '%s'", authPath)
+	return network.NewAuthFile(authPath), nil
+}
 
-	switch strings.ToLower(conf.CollectdSecurityLevel) {
+func parseSecurityLevel(level string) (network.SecurityLevel, error) {
+	switch strings.ToLower(level) {
 	case "", "none":
-		b.srv.SecurityLevel = network.None
+		return network.None, nil
 	case "sign":
-		b.srv.SecurityLevel = network.Sign
+		return network.Sign, nil
 	case "encrypt":
-		b.srv.SecurityLevel = network.Encrypt
-	default:
-		return UnknownSecurityLevel
+		return network.Encrypt, nil
 	}
-	log.Printf("CollectD security level: '%s'", conf.CollectdSecurityLevel)
-	return nil
+	return network.None, UnknownSecurityLevel
 }
 
-func (b *binaryProtoCollector) Configure(conf Config) error {
+func (b *binaryProtoCollector) parseOpts(conf Config) (network.ParseOpts, error) {
+	var opts network.ParseOpts
 	var err error
 
-	err = b.configureTypesDB(conf)
+	opts.TypesDB, err = loadTypesDB(conf)
 	if err != nil {
-		return err
+		return opts, err
+	}
+
+	opts.PasswordLookup, err = loadPasswordLookup(b.listener.authPath)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.SecurityLevel, err = parseSecurityLevel(b.listener.securityLevel)
+	if err != nil {
+		return opts, err
 	}
+	log.Printf("CollectD security level of '%s': '%s'", b.listener.source, b.listener.securityLevel)
+	return opts, nil
+}
 
-	err = b.configureSecurity(conf)
+func (b *binaryProtoCollector) Configure(conf Config) error {
+	opts, err := b.parseOpts(conf)
 	if err != nil {
 		return err
 	}
+	b.opts.Store(opts)
 
-	addr, err := net.ResolveUDPAddr("udp", b.address)
+	addr, err := net.ResolveUDPAddr("udp", b.listener.address)
 	if err != nil {
 		return err
 	}
 
 	if addr.IP != nil && addr.IP.IsMulticast() {
-		b.srv.Conn, err = net.ListenMulticastUDP("udp", nil, addr)
+		var ifi *net.Interface
+		if b.listener.iface != "" {
+			if ifi, err = net.InterfaceByName(b.listener.iface); err != nil {
+				return err
+			}
+		}
+		b.conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else if b.listener.iface != "" {
+		return fmt.Errorf("Interface set for the non multicast address '%s'", b.listener.address)
 	} else {
-		b.srv.Conn, err = net.ListenUDP("udp", addr)
+		b.conn, err = net.ListenUDP("udp", addr)
 	}
 	if err != nil {
 		return err
 	}
-	if conf.CollectdRecvBufferSize >= 0 {
-		if err = b.srv.Conn.SetReadBuffer(conf.CollectdRecvBufferSize); err != nil {
+	if b.listener.recvBufferSize >= 0 {
+		if err = b.conn.SetReadBuffer(b.listener.recvBufferSize); err != nil {
 			return err
 		}
 	}
 
 	b.lastUpdate = prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "collectd_update_binary_timestamp_seconds",
-			Help: "Unix timestamp of the last received collectd metrics binary push in seconds.",
+			Name:        "collectd_update_binary_timestamp_seconds",
+			Help:        "Unix timestamp of the last received collectd metrics binary push in seconds.",
+			ConstLabels: prometheus.Labels{"source": b.listener.source},
 		},
 	)
 
 	return nil
 }
 
+// PrepareReload re-reads types.db and the auth file. The returned
+// function makes them effective for the next packets.
+func (b *binaryProtoCollector) PrepareReload(conf Config) (func(), error) {
+	opts, err := b.parseOpts(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func() { b.opts.Store(opts) }, nil
+}
+
 func (b *binaryProtoCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- b.lastUpdate.Desc()
 }
 
-func (b *binaryProtoCollector) Run(ctx context.Context) {
-	log.Printf("CollectD starting listener: binary protocol")
-	log.Fatal(b.srv.ListenAndWrite(ctx))
+func (b *binaryProtoCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- b.lastUpdate
+}
+
+// Run reads packets until ctx is done. The packet being processed when
+// ctx is cancelled is fully written to the sink before returning.
+func (b *binaryProtoCollector) Run(ctx context.Context) error {
+	log.Printf("CollectD starting listener: binary protocol '%s'", b.listener.source)
+	go func() {
+		<-ctx.Done()
+		b.conn.Close()
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("CollectD stopped listener: binary protocol '%s'", b.listener.source)
+				return nil
+			}
+			return err
+		}
+
+		b.metrics.received.WithLabelValues(b.listener.source).Inc()
+
+		opts := b.opts.Load().(network.ParseOpts)
+		packet, err := parseBinaryPacket(buf[:n], opts)
+		if err != nil {
+			if isAuthError(err) {
+				b.metrics.authFailures.WithLabelValues(b.listener.source).Inc()
+			} else {
+				b.metrics.decodeFailures.WithLabelValues(b.listener.source).Inc()
+			}
+			log.Printf("CollectD binary protocol: parse error: %s", err)
+			continue
+		}
+		valueLists, notifications := packet.valueLists, packet.notifications
+		if len(valueLists) == 0 && len(notifications) == 0 && opts.SecurityLevel != network.None {
+			// the data below the security level is silently dropped
+			b.metrics.authFailures.WithLabelValues(b.listener.source).Inc()
+			continue
+		}
+		b.metrics.decoded.WithLabelValues(b.listener.source).Add(float64(len(valueLists)))
+		b.lastUpdate.SetToCurrentTime()
+
+		sctx := withSender(ctx, addr.String())
+		for _, vl := range valueLists {
+			b.sink.Write(sctx, vl)
+		}
+		for _, n := range notifications {
+			b.notifier.Notify(sctx, n)
+		}
+	}
 }
@@ -0,0 +1,194 @@
+package collectd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseBinaryListener(t *testing.T) {
+	conf := Config{
+		CollectdBinaryAddress:  ":25826",
+		CollectdSecurityLevel:  "None",
+		CollectdRecvBufferSize: 0,
+		CollectdBinaryListeners: []string{
+			"[ff18::efc0:4a42]:25826,interface=eth1,security-level=Encrypt,auth-file=/etc/collectd/auth,recv-buffer-size=1048576,source=vmnet",
+			"127.0.0.1:25827",
+		},
+	}
+	got, err := binaryListeners(conf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := []binaryListener{
+		{address: ":25826", securityLevel: "None", source: "binary"},
+		{
+			address:        "[ff18::efc0:4a42]:25826",
+			iface:          "eth1",
+			securityLevel:  "Encrypt",
+			authPath:       "/etc/collectd/auth",
+			recvBufferSize: 1048576,
+			source:         "vmnet",
+		},
+		{address: "127.0.0.1:25827", securityLevel: "None", source: "binary:127.0.0.1:25827"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+
+	invalid := []string{
+		"",
+		",source=vmnet",
+		"127.0.0.1:25827,source",
+		"127.0.0.1:25827,security-level=paranoid",
+		"127.0.0.1:25827,recv-buffer-size=big",
+		"127.0.0.1:25827,colour=blue",
+		"127.0.0.1:25827,source=binary",
+	}
+	for _, spec := range invalid {
+		conf.CollectdBinaryListeners = []string{spec}
+		if _, err := binaryListeners(conf); err == nil {
+			t.Errorf("%q: unexpected success", spec)
+		}
+	}
+}
+
+func TestBinaryListenerSecurity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binary")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	authPath := writeTestFile(t, dir, "auth", "alice: secret\n")
+
+	sink := &recordingSink{}
+	b := &binaryProtoCollector{
+		listener: binaryListener{
+			address:       "127.0.0.1:0",
+			securityLevel: "Sign",
+			authPath:      authPath,
+			source:        "signed",
+		},
+		sink:    sink,
+		metrics: newIngestMetrics(),
+	}
+	if err := b.Configure(Config{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.Run(ctx)
+	}()
+
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)},
+	}
+	conn, err := net.Dial("udp", b.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	for _, sign := range []bool{false, true} {
+		buf := network.NewBuffer(network.DefaultBufferSize)
+		if sign {
+			buf.Sign("alice", "secret")
+		}
+		if err := buf.Write(ctx, vl); err != nil {
+			t.Fatalf("%s", err)
+		}
+		packet, err := buf.Bytes()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if testutil.ToFloat64(b.metrics.received.WithLabelValues("signed")) == 2 {
+			break
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	if len(sink.valueLists) != 1 {
+		t.Errorf("got %d value lists, expected only the signed one", len(sink.valueLists))
+	}
+	if n := testutil.ToFloat64(b.metrics.authFailures.WithLabelValues("signed")); n != 1 {
+		t.Errorf("got %v auth failures, expected 1 for the unsigned packet", n)
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binary")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	authPath := writeTestFile(t, dir, "auth", "alice: secret\n")
+
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "host1", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1500000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)},
+	}
+	packet := func(level network.SecurityLevel, user, password string) []byte {
+		buf := network.NewBuffer(network.DefaultBufferSize)
+		switch level {
+		case network.Sign:
+			buf.Sign(user, password)
+		case network.Encrypt:
+			buf.Encrypt(user, password)
+		}
+		if err := buf.Write(context.Background(), vl); err != nil {
+			t.Fatalf("%s", err)
+		}
+		b, err := buf.Bytes()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return b
+	}
+	authFile := network.NewAuthFile(authPath)
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		lookup network.PasswordLookup
+		auth   bool
+	}{
+		{"wrong signature", packet(network.Sign, "alice", "guess"), authFile, true},
+		{"wrong encryption", packet(network.Encrypt, "alice", "guess"), authFile, true},
+		{"signed, no lookup", packet(network.Sign, "alice", "secret"), nil, true},
+		{"unknown user", packet(network.Sign, "bob", "secret"), authFile, true},
+		{"missing auth file", packet(network.Sign, "alice", "secret"), network.NewAuthFile(dir + "/missing"), true},
+		{"truncated", packet(network.None, "", "")[:7], authFile, false},
+	} {
+		_, err := parseBinaryPacket(tc.packet, network.ParseOpts{PasswordLookup: tc.lookup})
+		if err == nil {
+			t.Errorf("%s: unexpected success", tc.name)
+			continue
+		}
+		if isAuthError(err) != tc.auth {
+			t.Errorf("%s: %q: expected auth error %v", tc.name, err, tc.auth)
+		}
+	}
+}
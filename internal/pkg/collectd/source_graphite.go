@@ -0,0 +1,401 @@
+package collectd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// graphitePath describes how collectd's write_graphite lays out the
+// metric paths: <Prefix><host>.<plugin>[-<plugin_instance>].<type>[-<type_instance>][.<ds_name>]
+// write_graphite replaces the dots in the host name with the escape
+// character. If escape is set, it is turned back into dots, which alters
+// the host names really containing it; by default, the host names are
+// left as received, like the other parts.
+type graphitePath struct {
+	prefix   string
+	escape   string
+	interval time.Duration
+	// storeRates is true if write_graphite sends the DERIVE and COUNTER
+	// data sources as rates, which are then kept as gauges
+	storeRates bool
+}
+
+// parseGraphiteLine decodes a "<path> <value> <timestamp>" line into a
+// value list of a single data source. The graphite protocol carries
+// neither the data source type nor the data source names, which are
+// recovered from typesDB, if available.
+func parseGraphiteLine(line string, gp graphitePath, typesDB *api.TypesDB) (*api.ValueList, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, errors.New("expected: path value timestamp")
+	}
+	path, value, timestamp := fields[0], fields[1], fields[2]
+
+	if !strings.HasPrefix(path, gp.prefix) {
+		return nil, fmt.Errorf("path '%s' does not start with '%s'", path, gp.prefix)
+	}
+	parts := strings.Split(strings.TrimPrefix(path, gp.prefix), ".")
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, fmt.Errorf("unexpected path layout '%s'", path)
+	}
+
+	host := parts[0]
+	if gp.escape != "" {
+		host = strings.Replace(host, gp.escape, ".", -1)
+	}
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: host},
+		Interval:   gp.interval,
+	}
+	vl.Plugin, vl.PluginInstance = splitInstance(parts[1])
+	vl.Type, vl.TypeInstance = splitInstance(parts[2])
+	if vl.Host == "" || vl.Plugin == "" || vl.Type == "" {
+		return nil, fmt.Errorf("incomplete identifier in '%s'", path)
+	}
+	if err := checkIdentifier(vl.Identifier); err != nil {
+		return nil, err
+	}
+
+	secs, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp '%s'", timestamp)
+	}
+	vl.Time = time.Unix(0, int64(secs*float64(time.Second)))
+
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value '%s'", value)
+	}
+
+	dsname := "value"
+	if len(parts) == 4 {
+		dsname = parts[3]
+	}
+	v := api.Value(api.Gauge(num))
+	if src, ok := graphiteDataSource(typesDB, vl.Type, dsname); ok {
+		dsname = src.Name
+		switch {
+		case gp.storeRates:
+		case src.Type == deriveType:
+			v = api.Derive(int64(num))
+		case src.Type == counterType:
+			v = api.Counter(uint64(num))
+		}
+	}
+	vl.Values = []api.Value{v}
+	vl.DSNames = []string{dsname}
+	return vl, nil
+}
+
+// graphiteDataSource finds the data source of typ named dsname. The
+// name is omitted from the path of single-source types.
+func graphiteDataSource(typesDB *api.TypesDB, typ, dsname string) (api.DataSource, bool) {
+	ds, ok := graphiteDataSet(typesDB, typ)
+	if !ok {
+		return api.DataSource{}, false
+	}
+	if len(ds.Sources) == 1 {
+		return ds.Sources[0], true
+	}
+	for _, src := range ds.Sources {
+		if src.Name == dsname {
+			return src, true
+		}
+	}
+	return api.DataSource{}, false
+}
+
+// graphiteBatch merges back the lines of the data sources of a value
+// list, which write_graphite sends one after the other, so that every
+// value list is stored whole.
+type graphiteBatch struct {
+	pending *api.ValueList
+}
+
+// add merges vl, of a single data source, into the pending value list if
+// it is of the same identifier and time. Returns the value lists which
+// are complete.
+func (b *graphiteBatch) add(vl *api.ValueList, typesDB *api.TypesDB) []*api.ValueList {
+	var done []*api.ValueList
+	p := b.pending
+	if p != nil && (p.Identifier != vl.Identifier || !p.Time.Equal(vl.Time) || hasDSName(p, vl.DSNames[0])) {
+		done = append(done, p)
+		p = nil
+	}
+	if p == nil {
+		b.pending = vl
+	} else {
+		p.Values = append(p.Values, vl.Values[0])
+		p.DSNames = append(p.DSNames, vl.DSNames[0])
+	}
+
+	sortDataSources(b.pending, typesDB)
+	if ds, ok := graphiteDataSet(typesDB, b.pending.Type); ok {
+		if len(b.pending.Values) == len(ds.Sources) {
+			done = append(done, b.pending)
+			b.pending = nil
+		}
+	}
+	return done
+}
+
+// flush returns the pending value list, even if incomplete.
+func (b *graphiteBatch) flush() []*api.ValueList {
+	if b.pending == nil {
+		return nil
+	}
+	vl := b.pending
+	b.pending = nil
+	return []*api.ValueList{vl}
+}
+
+func hasDSName(vl *api.ValueList, name string) bool {
+	for _, n := range vl.DSNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func splitInstance(s string) (string, string) {
+	if i := strings.Index(s, "-"); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func graphiteDataSet(typesDB *api.TypesDB, typ string) (*api.DataSet, bool) {
+	if typesDB == nil {
+		return nil, false
+	}
+	return typesDB.DataSet(typ)
+}
+
+// graphiteFlushDelay is how long an incomplete value list waits for the
+// lines of its other data sources on a TCP connection.
+const graphiteFlushDelay = 500 * time.Millisecond
+
+// graphiteCollector accepts the collectd write_graphite plaintext
+// protocol, both over TCP and UDP, on the same address.
+type graphiteCollector struct {
+	address    string
+	sink       dataSink
+	path       graphitePath
+	typesDB    atomic.Value // *api.TypesDB
+	listener   net.Listener
+	conn       *net.UDPConn
+	metrics    *ingestMetrics
+	lastUpdate prometheus.Gauge
+}
+
+func (g *graphiteCollector) Configure(conf Config) error {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return err
+	}
+	g.typesDB.Store(typesDB)
+
+	g.path = graphitePath{
+		prefix:     conf.CollectdGraphitePrefix,
+		escape:     conf.CollectdGraphiteEscapeCharacter,
+		interval:   conf.CollectdGraphiteInterval,
+		storeRates: conf.CollectdGraphiteStoreRates,
+	}
+
+	g.listener, err = net.Listen("tcp", g.address)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", g.address)
+	if err != nil {
+		return err
+	}
+	g.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	g.lastUpdate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "collectd_update_graphite_timestamp_seconds",
+			Help: "Unix timestamp of the last received collectd metrics graphite push in seconds.",
+		},
+	)
+
+	return nil
+}
+
+// PrepareReload re-reads types.db, used to recover the data source types.
+func (g *graphiteCollector) PrepareReload(conf Config) (func(), error) {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func() { g.typesDB.Store(typesDB) }, nil
+}
+
+func (g *graphiteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.lastUpdate.Desc()
+}
+
+func (g *graphiteCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- g.lastUpdate
+}
+
+func (g *graphiteCollector) Run(ctx context.Context) error {
+	log.Printf("CollectD starting listener: graphite")
+
+	conns := make(map[net.Conn]struct{})
+	connsLock := &sync.Mutex{}
+	go func() {
+		<-ctx.Done()
+		g.listener.Close()
+		g.conn.Close()
+		connsLock.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsLock.Unlock()
+	}()
+
+	wg := &sync.WaitGroup{}
+	errc := make(chan error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := g.serveUDP(ctx)
+		if err != nil {
+			// stop accepting TCP connections too
+			g.listener.Close()
+		}
+		errc <- err
+	}()
+
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				errc <- err
+			}
+			break
+		}
+		connsLock.Lock()
+		conns[conn] = struct{}{}
+		if ctx.Err() != nil {
+			// raced with the shutdown
+			conn.Close()
+		}
+		connsLock.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.serveTCP(ctx, conn)
+			connsLock.Lock()
+			delete(conns, conn)
+			connsLock.Unlock()
+			conn.Close()
+		}()
+	}
+
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+	log.Printf("CollectD stopped listener: graphite")
+	return nil
+}
+
+// serveTCP reads the lines of conn. An incomplete value list is written
+// once the next line is of another value list, once no line was received
+// for graphiteFlushDelay, or when the connection is closed: the lines of
+// a value list may be split across reads.
+func (g *graphiteCollector) serveTCP(ctx context.Context, conn net.Conn) {
+	ctx = withSender(ctx, senderHost(conn.RemoteAddr().String()))
+	batch := &graphiteBatch{}
+	r := bufio.NewReader(conn)
+	var partial string
+	for {
+		var deadline time.Time
+		if batch.pending != nil {
+			deadline = time.Now().Add(graphiteFlushDelay)
+		}
+		conn.SetReadDeadline(deadline)
+
+		line, err := r.ReadString('\n')
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			partial += line
+			g.write(ctx, batch.flush())
+			continue
+		}
+		g.handleLine(ctx, partial+line, batch)
+		partial = ""
+		if err != nil {
+			g.write(ctx, batch.flush())
+			return
+		}
+	}
+}
+
+func (g *graphiteCollector) serveUDP(ctx context.Context) error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		sctx := withSender(ctx, addr.String())
+		batch := &graphiteBatch{}
+		scanner := bufio.NewScanner(bytes.NewReader(buf[:n]))
+		for scanner.Scan() {
+			g.handleLine(sctx, scanner.Text(), batch)
+		}
+		g.write(sctx, batch.flush())
+	}
+}
+
+func (g *graphiteCollector) handleLine(ctx context.Context, line string, batch *graphiteBatch) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	g.metrics.received.WithLabelValues("graphite").Inc()
+
+	typesDB := g.typesDB.Load().(*api.TypesDB)
+	vl, err := parseGraphiteLine(line, g.path, typesDB)
+	if err != nil {
+		g.metrics.decodeFailures.WithLabelValues("graphite").Inc()
+		log.Printf("CollectD graphite protocol: parse error: %s", err)
+		return
+	}
+	g.lastUpdate.SetToCurrentTime()
+
+	g.write(ctx, batch.add(vl, typesDB))
+}
+
+func (g *graphiteCollector) write(ctx context.Context, valueLists []*api.ValueList) {
+	g.metrics.decoded.WithLabelValues("graphite").Add(float64(len(valueLists)))
+	for _, vl := range valueLists {
+		g.sink.Write(ctx, vl)
+	}
+}
@@ -0,0 +1,173 @@
+package collectd
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseGraphiteLine(t *testing.T) {
+	gp := graphitePath{
+		prefix:   "collectd.",
+		escape:   "_",
+		interval: 10 * time.Second,
+	}
+	cases := []struct {
+		line     string
+		expected api.ValueList
+	}{
+		{"collectd.host_example_com.load.load.shortterm 0.5 1500000000",
+			api.ValueList{
+				Identifier: api.Identifier{Host: "host.example.com", Plugin: "load", Type: "load"},
+				Time:       time.Unix(1500000000, 0),
+				Interval:   10 * time.Second,
+				Values:     []api.Value{api.Gauge(0.5)},
+				DSNames:    []string{"shortterm"},
+			}},
+		{"collectd.vm0.interface-eth0.if_octets.rx 1234 1500000000",
+			api.ValueList{
+				Identifier: api.Identifier{Host: "vm0", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+				Time:       time.Unix(1500000000, 0),
+				Interval:   10 * time.Second,
+				Values:     []api.Value{api.Derive(1234)},
+				DSNames:    []string{"rx"},
+			}},
+		{"collectd.vm0.virt.counter-vcpu_0 42 1500000000.5",
+			api.ValueList{
+				Identifier: api.Identifier{Host: "vm0", Plugin: "virt", Type: "counter", TypeInstance: "vcpu_0"},
+				Time:       time.Unix(1500000000, 500000000),
+				Interval:   10 * time.Second,
+				Values:     []api.Value{api.Counter(42)},
+				DSNames:    []string{"value"},
+			}},
+		{"collectd.vm0.memory.memory-used 1024 1500000000",
+			api.ValueList{
+				Identifier: api.Identifier{Host: "vm0", Plugin: "memory", Type: "memory", TypeInstance: "used"},
+				Time:       time.Unix(1500000000, 0),
+				Interval:   10 * time.Second,
+				Values:     []api.Value{api.Gauge(1024)},
+				DSNames:    []string{"value"},
+			}},
+	}
+
+	typesDB := newTestTypesDB(t)
+	for _, c := range cases {
+		got, err := parseGraphiteLine(c.line, gp, typesDB)
+		if err != nil {
+			t.Errorf("%q: %s", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, c.expected) {
+			t.Errorf("%q: got %#v, expected %#v", c.line, *got, c.expected)
+		}
+	}
+
+	invalid := []string{
+		"collectd.vm0.load.load 1",
+		"graphite.vm0.load.load 1 1500000000",
+		"collectd.vm0.load 1 1500000000",
+		"collectd.vm0.a.b.c.d 1 1500000000",
+		"collectd.vm0.load.load one 1500000000",
+		"collectd.vm0.load.load 1 yesterday",
+		"collectd.vm\xff.load.load 1 1500000000",
+	}
+	for _, line := range invalid {
+		if _, err := parseGraphiteLine(line, gp, typesDB); err == nil {
+			t.Errorf("%q: expected error, got none", line)
+		}
+	}
+}
+
+func TestGraphiteStoreRates(t *testing.T) {
+	gp := graphitePath{prefix: "collectd.", interval: 10 * time.Second, storeRates: true}
+	got, err := parseGraphiteLine("collectd.vm0.interface-eth0.if_octets.rx 1234.5 1500000000", gp, newTestTypesDB(t))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !reflect.DeepEqual(got.Values, []api.Value{api.Gauge(1234.5)}) {
+		t.Errorf("got %v, expected the rate as a gauge", got.Values)
+	}
+}
+
+func TestGraphiteBatch(t *testing.T) {
+	gp := graphitePath{prefix: "collectd.", interval: 10 * time.Second, storeRates: true}
+	typesDB := newTestTypesDB(t)
+	batch := &graphiteBatch{}
+	var got []*api.ValueList
+	for _, line := range []string{
+		"collectd.vm0.interface-eth0.if_octets.tx 200 1500000000",
+		"collectd.vm0.interface-eth0.if_octets.rx 100 1500000000",
+		"collectd.vm0.interface-eth0.if_octets.tx 210 1500000010",
+	} {
+		vl, err := parseGraphiteLine(line, gp, typesDB)
+		if err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		got = append(got, batch.add(vl, typesDB)...)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d value lists before the flush, expected the complete one", len(got))
+	}
+	got = append(got, batch.flush()...)
+
+	id := api.Identifier{Host: "vm0", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}
+	expected := []*api.ValueList{
+		{
+			Identifier: id,
+			Time:       time.Unix(1500000000, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(100), api.Gauge(200)},
+			DSNames:    []string{"rx", "tx"},
+		},
+		{
+			Identifier: id,
+			Time:       time.Unix(1500000010, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(210)},
+			DSNames:    []string{"tx"},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+}
+
+func TestGraphiteTCPSplitReads(t *testing.T) {
+	sink := &recordingSink{}
+	g := &graphiteCollector{
+		sink:       sink,
+		path:       graphitePath{prefix: "collectd.", interval: 10 * time.Second, storeRates: true},
+		metrics:    newIngestMetrics(),
+		lastUpdate: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+	}
+	g.typesDB.Store(newTestTypesDB(t))
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		g.serveTCP(context.Background(), server)
+		close(done)
+	}()
+	// the data sources of a value list in two reads
+	for _, line := range []string{
+		"collectd.vm0.interface-eth0.if_octets.tx 200 1500000000\n",
+		"collectd.vm0.interface-eth0.if_octets.rx 100 1500000000\n",
+	} {
+		if _, err := io.WriteString(client, line); err != nil {
+			t.Fatalf("%s", err)
+		}
+		time.Sleep(graphiteFlushDelay / 10)
+	}
+	client.Close()
+	<-done
+
+	if len(sink.valueLists) != 1 || !reflect.DeepEqual(sink.valueLists[0].Values, []api.Value{api.Gauge(100), api.Gauge(200)}) {
+		t.Errorf("got %+v, expected a single value list with rx and tx", sink.valueLists)
+	}
+}
@@ -0,0 +1,348 @@
+package collectd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// parseInfluxPrecision maps the precision names of the InfluxDB write
+// API to the duration of one timestamp unit.
+func parseInfluxPrecision(p string) (time.Duration, error) {
+	switch p {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("Unknown InfluxDB precision: '%s'", p)
+}
+
+// parseInfluxLines decodes the InfluxDB line protocol as sent by collectd
+// write_http with Format "INFLUXDB": the measurement is the plugin, the
+// host, instance, type and type_instance tags complete the identifier
+// and every field is a data source.
+func parseInfluxLines(r io.Reader, precision time.Duration, typesDB *api.TypesDB, interval time.Duration, now time.Time) ([]*api.ValueList, error) {
+	var valueLists []*api.ValueList
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vl, err := parseInfluxLine(line, precision, typesDB, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		vl.Interval = interval
+		valueLists = append(valueLists, vl)
+	}
+	return valueLists, scanner.Err()
+}
+
+func parseInfluxLine(line string, precision time.Duration, typesDB *api.TypesDB, now time.Time) (*api.ValueList, error) {
+	sections := splitEscaped(line, ' ', -1)
+	if len(sections) != 2 && len(sections) != 3 {
+		return nil, errors.New("expected: measurement[,tags] fields [timestamp]")
+	}
+
+	keys := splitEscaped(sections[0], ',', -1)
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Plugin: unescapeInflux(keys[0])},
+		Time:       now,
+	}
+	for _, tag := range keys[1:] {
+		kv := splitEscaped(tag, '=', 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad tag '%s'", tag)
+		}
+		value := unescapeInflux(kv[1])
+		switch unescapeInflux(kv[0]) {
+		case "host":
+			vl.Host = value
+		case "instance":
+			vl.PluginInstance = value
+		case "type":
+			vl.Type = value
+		case "type_instance":
+			vl.TypeInstance = value
+		}
+	}
+	if vl.Type == "" {
+		vl.Type = vl.Plugin
+	}
+	if vl.Host == "" || vl.Plugin == "" {
+		return nil, errors.New("missing measurement or host tag")
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp '%s'", sections[2])
+		}
+		vl.Time = time.Unix(0, ts*int64(precision))
+	}
+
+	fields := make(map[string]string)
+	var names []string
+	for _, field := range splitEscaped(sections[1], ',', -1) {
+		kv := splitEscaped(field, '=', 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad field '%s'", field)
+		}
+		name := unescapeInflux(kv[0])
+		fields[name] = kv[1]
+		names = append(names, name)
+	}
+
+	var sources []api.DataSource
+	if typesDB != nil {
+		if ds, ok := typesDB.DataSet(vl.Type); ok {
+			sources = ds.Sources
+		}
+	}
+	if sources == nil {
+		for _, name := range names {
+			sources = append(sources, api.DataSource{Name: name})
+		}
+	}
+
+	for _, src := range sources {
+		raw, ok := fields[src.Name]
+		if !ok && len(sources) == 1 && len(names) == 1 {
+			raw, ok = fields[names[0]], true
+		}
+		if !ok {
+			return nil, fmt.Errorf("missing field '%s' for type '%s'", src.Name, vl.Type)
+		}
+		v, err := parseInfluxValue(raw, src.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %s", src.Name, err)
+		}
+		vl.Values = append(vl.Values, v)
+		vl.DSNames = append(vl.DSNames, src.Name)
+	}
+	return vl, nil
+}
+
+// parseInfluxValue converts a field value. Without type information,
+// integers ("42i") are derives and floats are gauges.
+func parseInfluxValue(raw string, typ reflect.Type) (api.Value, error) {
+	isInt := strings.HasSuffix(raw, "i")
+	raw = strings.TrimSuffix(raw, "i")
+	num, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value '%s'", raw)
+	}
+	switch typ {
+	case gaugeType:
+		return api.Gauge(num), nil
+	case deriveType:
+		return api.Derive(int64(num)), nil
+	case counterType:
+		return api.Counter(uint64(num)), nil
+	}
+	if isInt {
+		return api.Derive(int64(num)), nil
+	}
+	return api.Gauge(num), nil
+}
+
+// splitEscaped splits s around sep, ignoring the separators escaped
+// by a backslash or enclosed in double quotes.
+func splitEscaped(s string, sep byte, n int) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes && (n <= 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// handleInfluxPost serves the InfluxDB write API on the HTTP receiver.
+func (j *httpJSONCollector) handleInfluxPost(w http.ResponseWriter, r *http.Request) {
+	j.metrics.received.WithLabelValues("influxdb").Inc()
+
+	precision := j.influxPrecision
+	if p := r.URL.Query().Get("precision"); p != "" {
+		var err error
+		precision, err = parseInfluxPrecision(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var valueLists []*api.ValueList
+	body, err := j.requestBody(w, r)
+	if err == nil {
+		typesDB := j.typesDB.Load().(*api.TypesDB)
+		valueLists, err = parseInfluxLines(body, precision, typesDB, j.influxInterval, time.Now())
+	}
+	if err == nil {
+		err = j.checkValueLists(valueLists)
+	}
+	if err != nil {
+		j.requestFailed(w, "influxdb", err)
+		return
+	}
+	var hosts []string
+	for _, vl := range valueLists {
+		hosts = append(hosts, vl.Host)
+	}
+	if !j.authorize(w, r, "influxdb", hosts) {
+		return
+	}
+	j.metrics.decoded.WithLabelValues("influxdb").Add(float64(len(valueLists)))
+	j.lastUpdate.SetToCurrentTime()
+
+	ctx := withSender(r.Context(), senderHost(r.RemoteAddr))
+	for _, vl := range valueLists {
+		j.influxSink.Write(ctx, vl)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// influxUDPCollector accepts the InfluxDB line protocol over UDP.
+type influxUDPCollector struct {
+	address    string
+	sink       dataSink
+	conn       *net.UDPConn
+	precision  time.Duration
+	interval   time.Duration
+	typesDB    atomic.Value // *api.TypesDB
+	metrics    *ingestMetrics
+	lastUpdate prometheus.Gauge
+}
+
+func (i *influxUDPCollector) Configure(conf Config) error {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return err
+	}
+	i.typesDB.Store(typesDB)
+
+	i.precision, err = parseInfluxPrecision(conf.CollectdInfluxDBPrecision)
+	if err != nil {
+		return err
+	}
+	i.interval = conf.CollectdInfluxDBInterval
+
+	addr, err := net.ResolveUDPAddr("udp", i.address)
+	if err != nil {
+		return err
+	}
+	i.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	i.lastUpdate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "collectd_update_influxdb_timestamp_seconds",
+			Help: "Unix timestamp of the last received collectd metrics InfluxDB UDP push in seconds.",
+		},
+	)
+
+	return nil
+}
+
+// PrepareReload re-reads types.db, used to recover the data source types.
+func (i *influxUDPCollector) PrepareReload(conf Config) (func(), error) {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func() { i.typesDB.Store(typesDB) }, nil
+}
+
+func (i *influxUDPCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- i.lastUpdate.Desc()
+}
+
+func (i *influxUDPCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- i.lastUpdate
+}
+
+func (i *influxUDPCollector) Run(ctx context.Context) error {
+	log.Printf("CollectD starting listener: InfluxDB UDP")
+	go func() {
+		<-ctx.Done()
+		i.conn.Close()
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := i.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("CollectD stopped listener: InfluxDB UDP")
+				return nil
+			}
+			return err
+		}
+		i.metrics.received.WithLabelValues("influxdb").Inc()
+
+		typesDB := i.typesDB.Load().(*api.TypesDB)
+		valueLists, err := parseInfluxLines(bytes.NewReader(buf[:n]), i.precision, typesDB, i.interval, time.Now())
+		if err != nil {
+			i.metrics.decodeFailures.WithLabelValues("influxdb").Inc()
+			log.Printf("CollectD InfluxDB protocol: parse error: %s", err)
+			continue
+		}
+		i.metrics.decoded.WithLabelValues("influxdb").Add(float64(len(valueLists)))
+		i.lastUpdate.SetToCurrentTime()
+
+		sctx := withSender(ctx, addr.String())
+		for _, vl := range valueLists {
+			i.sink.Write(sctx, vl)
+		}
+	}
+}
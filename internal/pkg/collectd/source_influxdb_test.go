@@ -0,0 +1,74 @@
+package collectd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestParseInfluxLines(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	input := "load,host=vm0,type=load shortterm=0.5,midterm=0.25,longterm=0.125 1500000010000\n" +
+		"interface,host=vm0,instance=eth0,type=if_octets rx=10i,tx=20i 1500000020000\n" +
+		"memory,host=host\\ 1,type=memory,type_instance=used value=1024\n" +
+		"custom,host=vm0 reads=3i,ratio=0.5\n"
+
+	got, err := parseInfluxLines(strings.NewReader(input), time.Millisecond, newTestTypesDB(t), 10*time.Second, now)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := []api.ValueList{
+		{
+			Identifier: api.Identifier{Host: "vm0", Plugin: "load", Type: "load"},
+			Time:       time.Unix(1500000010, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(0.5), api.Gauge(0.25), api.Gauge(0.125)},
+			DSNames:    []string{"shortterm", "midterm", "longterm"},
+		},
+		{
+			Identifier: api.Identifier{Host: "vm0", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+			Time:       time.Unix(1500000020, 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Derive(10), api.Derive(20)},
+			DSNames:    []string{"rx", "tx"},
+		},
+		{
+			Identifier: api.Identifier{Host: "host 1", Plugin: "memory", Type: "memory", TypeInstance: "used"},
+			Time:       now,
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1024)},
+			DSNames:    []string{"value"},
+		},
+		{
+			Identifier: api.Identifier{Host: "vm0", Plugin: "custom", Type: "custom"},
+			Time:       now,
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Derive(3), api.Gauge(0.5)},
+			DSNames:    []string{"reads", "ratio"},
+		},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %d value lists, expected %d", len(got), len(expected))
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(*got[i], expected[i]) {
+			t.Errorf("line %d: got %#v, expected %#v", i+1, *got[i], expected[i])
+		}
+	}
+
+	invalid := []string{
+		"load,host=vm0",
+		"load shortterm=1",
+		"load,host=vm0,type=load shortterm=1",
+		"load,host=vm0 value=abc",
+		"load,host=vm0 value=1 yesterday",
+	}
+	for _, line := range invalid {
+		if _, err := parseInfluxLines(strings.NewReader(line), time.Nanosecond, newTestTypesDB(t), 0, now); err == nil {
+			t.Errorf("%q: expected error, got none", line)
+		}
+	}
+}
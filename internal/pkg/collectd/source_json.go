@@ -1,11 +1,20 @@
 package collectd
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"collectd.org/api"
@@ -13,21 +22,85 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeCommand = "text/plain"
+)
+
+var (
+	errTooManyValueLists   = errors.New("Too many value lists")
+	errUnsupportedEncoding = errors.New("Unsupported content encoding")
+)
+
+// httpJSONCollector receives the collectd write_http pushes, either in
+// JSON or in Command (PUTVAL) format, and optionally in the InfluxDB
+// line protocol on a separate path.
 type httpJSONCollector struct {
 	address    string
-	sink       dataSink
+	sink       metaSink
+	notifier   notificationSink
 	router     *mux.Router
+	tlsConfig  *tls.Config
+	auth       atomic.Value // *httpAuth
+	typesDB    atomic.Value // *api.TypesDB
+	metrics    *ingestMetrics
 	lastUpdate prometheus.Gauge
+	// web returns the web configuration file, applied unless overridden
+	// by the collectd-json-* TLS and auth settings
+	web func() *webConfig
+
+	maxBodySize     int64
+	maxValueLists   int
+	commandInterval time.Duration
+
+	influxSink      dataSink
+	influxPrecision time.Duration
+	influxInterval  time.Duration
 }
 
 func (j *httpJSONCollector) Configure(conf Config) error {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return err
+	}
+	j.typesDB.Store(typesDB)
+
+	auth, err := loadJSONAuth(conf)
+	if err != nil {
+		return err
+	}
+	j.auth.Store(auth)
+	j.tlsConfig, err = loadTLSConfig(conf.CollectdJSONTLSCertFile, conf.CollectdJSONTLSKeyFile, conf.CollectdJSONTLSClientCAFile)
+	if err != nil {
+		return err
+	}
+
+	j.maxBodySize = conf.CollectdJSONMaxBodySize
+	j.maxValueLists = conf.CollectdJSONMaxValueLists
+	j.commandInterval = conf.CollectdJSONCommandInterval
+
 	j.router = mux.NewRouter().StrictSlash(true)
 	name := "CollectdJSONPost"
 	j.router.
 		Methods("POST").
 		Path(conf.CollectdJSONURLPath).
 		Name(name).
-		Handler(Logger(http.HandlerFunc(j.handlePost), name))
+		Handler(Logger(requireAuth(j.currentAuth, http.HandlerFunc(j.handlePost)), name))
+
+	if conf.CollectdInfluxDBURLPath != "" {
+		j.influxPrecision, err = parseInfluxPrecision(conf.CollectdInfluxDBPrecision)
+		if err != nil {
+			return err
+		}
+		j.influxInterval = conf.CollectdInfluxDBInterval
+		name = "CollectdInfluxDBPost"
+		j.router.
+			Methods("POST").
+			Path(conf.CollectdInfluxDBURLPath).
+			Name(name).
+			Handler(Logger(requireAuth(j.currentAuth, http.HandlerFunc(j.handleInfluxPost)), name))
+		log.Printf("CollectD HTTP InfluxDB URL path: '%s'", conf.CollectdInfluxDBURLPath)
+	}
 
 	j.lastUpdate = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -39,31 +112,240 @@ func (j *httpJSONCollector) Configure(conf Config) error {
 	return nil
 }
 
+func loadJSONAuth(conf Config) (*httpAuth, error) {
+	return loadHTTPAuth(conf.CollectdJSONAuthFile, conf.CollectdJSONTokensFile, conf.CollectdJSONAuthzFile)
+}
+
+func (j *httpJSONCollector) currentAuth() *httpAuth {
+	return j.auth.Load().(*httpAuth)
+}
+
+// authorize checks that the client of r may report for all the hosts.
+func (j *httpJSONCollector) authorize(w http.ResponseWriter, r *http.Request, source string, hosts []string) bool {
+	identity := requestIdentity(r)
+	for _, host := range hosts {
+		if !j.currentAuth().authorized(identity, host) {
+			j.metrics.authFailures.WithLabelValues(source).Inc()
+			log.Printf("CollectD HTTP: '%s' may not report for host '%s'", identity, host)
+			http.Error(w, fmt.Sprintf("Not allowed to report for host '%s'", host), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// PrepareReload re-reads types.db, needed to decode the PUTVAL commands,
+// and the auth files.
+func (j *httpJSONCollector) PrepareReload(conf Config) (func(), error) {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := loadJSONAuth(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		j.typesDB.Store(typesDB)
+		j.auth.Store(auth)
+	}, nil
+}
+
 func (j *httpJSONCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- j.lastUpdate.Desc()
 }
 
-func (j *httpJSONCollector) Run(ctx context.Context) {
+func (j *httpJSONCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- j.lastUpdate
+}
+
+func (j *httpJSONCollector) Run(ctx context.Context) error {
 	log.Printf("CollectD starting listener: HTTP JSON")
-	log.Fatal(http.ListenAndServe(j.address, j.router))
+	srv := &http.Server{
+		Addr:      j.address,
+		Handler:   j.handler(),
+		TLSConfig: j.tlsConfig,
+	}
+	if j.tlsConfig == nil && j.web != nil {
+		setupWebServer(srv, j.web)
+	}
+	err := runHTTPServer(ctx, srv)
+	if err == nil {
+		log.Printf("CollectD stopped listener: HTTP JSON")
+	}
+	return err
+}
+
+// handler applies the web configuration file to the router, its basic
+// auth users being ignored once the receiver has its own users or tokens.
+func (j *httpJSONCollector) handler() http.Handler {
+	if j.web == nil {
+		return j.router
+	}
+	return webHandler(j.web, func() bool { return j.currentAuth().required() }, j.router)
 }
 
 func (j *httpJSONCollector) handlePost(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body)
+	j.metrics.received.WithLabelValues("json").Inc()
+
+	typesDB := j.typesDB.Load().(*api.TypesDB)
+	push := &jsonPush{}
+	body, err := j.requestBody(w, r)
+	if err == nil {
+		switch contentType(r) {
+		case "", contentTypeJSON:
+			push, err = parseJSONPush(body, j.maxValueLists, typesDB)
+		case contentTypeCommand:
+			push.valueLists, err = parseCommands(body, typesDB, j.commandInterval, time.Now())
+		default:
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if err == nil {
+		err = j.checkValueLists(push.valueLists)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		j.requestFailed(w, "json", err)
+		return
+	}
+	var hosts []string
+	for _, vl := range push.valueLists {
+		hosts = append(hosts, vl.Host)
+	}
+	for _, n := range push.notifications {
+		hosts = append(hosts, n.Host)
+	}
+	if !j.authorize(w, r, "json", hosts) {
 		return
 	}
+	j.metrics.decoded.WithLabelValues("json").Add(float64(len(push.valueLists)))
+	j.lastUpdate.SetToCurrentTime()
 
-	var valueLists []*api.ValueList
-	if err := json.Unmarshal(data, &valueLists); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	ctx := withSender(r.Context(), senderHost(r.RemoteAddr))
+	resp := pushResponse{Rejected: push.rejected}
+	for i, vl := range push.valueLists {
+		var err error
+		if push.meta != nil {
+			err = j.sink.WriteMeta(ctx, vl, push.meta[i])
+		} else {
+			err = j.sink.Write(ctx, vl)
+		}
+		if err != nil {
+			index := i
+			if push.index != nil {
+				index = push.index[i]
+			}
+			push.reject(index, vl.Identifier.String(), rejectWriteFailed, err)
+			continue
+		}
+		resp.Accepted++
+	}
+	for i, n := range push.notifications {
+		if err := j.notifier.Notify(ctx, n); err != nil {
+			push.reject(push.notificationIndex[i], n.Identifier.String(), rejectWriteFailed, err)
+			continue
+		}
+		resp.Accepted++
+	}
+
+	resp.Rejected = push.rejected
+	sort.SliceStable(resp.Rejected, func(a, b int) bool { return resp.Rejected[a].Index < resp.Rejected[b].Index })
+	for _, rejected := range resp.Rejected {
+		j.metrics.rejected.WithLabelValues("json", rejected.Reason).Inc()
+	}
+	if len(resp.Rejected) > 0 {
+		log.Printf("CollectD HTTP: rejected %d of %d entries", len(resp.Rejected), len(resp.Rejected)+resp.Accepted)
+	}
+
+	failed := resp.Accepted == 0 && len(resp.Rejected) > 0
+	if contentType(r) == contentTypeCommand {
+		// write_http expects no body in Command format
+		if failed {
+			w.WriteHeader(pushStatus(resp.Rejected))
+		}
 		return
 	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	if failed {
+		w.WriteHeader(pushStatus(resp.Rejected))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
 
-	for _, vl := range valueLists {
-		j.sink.Write(r.Context(), vl)
+// pushStatus returns the status of a push of which no entry was accepted:
+// the client may retry once the exporter is able to store the entries
+// again, but not the malformed ones.
+func pushStatus(rejected []rejectedEntry) int {
+	for _, r := range rejected {
+		if r.Reason == rejectWriteFailed {
+			return http.StatusServiceUnavailable
+		}
+	}
+	return http.StatusBadRequest
+}
+
+// requestBody returns the body of r, decompressed as its Content-Encoding
+// tells. Reading more than maxBodySize bytes of the decompressed body, if
+// positive, fails with an *http.MaxBytesError.
+func (j *httpJSONCollector) requestBody(w http.ResponseWriter, r *http.Request) (io.Reader, error) {
+	var body io.ReadCloser
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		body = r.Body
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	if j.maxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, j.maxBodySize)
+	}
+	return body, nil
+}
+
+func (j *httpJSONCollector) checkValueLists(valueLists []*api.ValueList) error {
+	if j.maxValueLists > 0 && len(valueLists) > j.maxValueLists {
+		return errTooManyValueLists
+	}
+	return nil
+}
+
+// requestFailed answers a push which could not be decoded.
+func (j *httpJSONCollector) requestFailed(w http.ResponseWriter, source string, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr), err == errTooManyValueLists:
+		log.Printf("CollectD HTTP: %s push rejected: %s", source, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err == errUnsupportedEncoding:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		j.metrics.decodeFailures.WithLabelValues(source).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func contentType(r *http.Request) string {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ct
 	}
+	return mediaType
 }
 
 func Logger(inner http.Handler, name string) http.Handler {
@@ -0,0 +1,236 @@
+package collectd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testJSONValueList = `{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1500000000,"interval":10,"host":"host1","plugin":"load","type":"load"}`
+
+func compress(t *testing.T, encoding, data string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return data
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return buf.String()
+}
+
+func TestHTTPPushLimits(t *testing.T) {
+	sink := &recordingSink{}
+	j := &httpJSONCollector{sink: sink, metrics: newIngestMetrics()}
+	err := j.Configure(Config{
+		CollectdJSONURLPath:       "/collectd",
+		CollectdJSONMaxBodySize:   1000,
+		CollectdJSONMaxValueLists: 2,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	single := "[" + testJSONValueList + "]"
+	triple := "[" + strings.Repeat(testJSONValueList+",", 2) + testJSONValueList + "]"
+	padded := "[" + testJSONValueList + strings.Repeat(" ", 2000) + "]"
+	testCases := []struct {
+		name, encoding, body string
+		status, written      int
+	}{
+		{"plain", "", single, http.StatusOK, 1},
+		{"gzip", "gzip", compress(t, "gzip", single), http.StatusOK, 1},
+		{"deflate", "deflate", compress(t, "deflate", single), http.StatusOK, 1},
+		{"too many value lists", "gzip", compress(t, "gzip", triple), http.StatusRequestEntityTooLarge, 0},
+		{"too large once decompressed", "gzip", compress(t, "gzip", padded), http.StatusRequestEntityTooLarge, 0},
+		{"unsupported encoding", "br", single, http.StatusUnsupportedMediaType, 0},
+		{"corrupted", "gzip", single, http.StatusBadRequest, 0},
+	}
+	for _, tc := range testCases {
+		sink.valueLists = nil
+		r := httptest.NewRequest("POST", "/collectd", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		if tc.encoding != "" {
+			r.Header.Set("Content-Encoding", tc.encoding)
+		}
+		rec := httptest.NewRecorder()
+		j.router.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d, expected %d: %s", tc.name, rec.Code, tc.status, rec.Body.String())
+		}
+		if len(sink.valueLists) != tc.written {
+			t.Errorf("%s: got %d value lists, expected %d", tc.name, len(sink.valueLists), tc.written)
+		}
+	}
+}
+
+func TestHTTPPushRejections(t *testing.T) {
+	sink := &recordingSink{}
+	j := &httpJSONCollector{sink: sink, metrics: newIngestMetrics()}
+	if err := j.Configure(Config{CollectdJSONURLPath: "/collectd"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	broken := `{"values":[1],"dstypes":["gauge","gauge"],"host":"host1","plugin":"load","type":"load"}`
+
+	for _, tc := range []struct {
+		body     string
+		err      error
+		status   int
+		expected pushResponse
+	}{
+		{
+			"[" + testJSONValueList + "," + broken + "]",
+			nil,
+			http.StatusOK,
+			pushResponse{Accepted: 1, Rejected: []rejectedEntry{{Index: 1, Reason: rejectMalformed}}},
+		},
+		{
+			"[" + broken + "]",
+			nil,
+			http.StatusBadRequest,
+			pushResponse{Rejected: []rejectedEntry{{Index: 0, Reason: rejectMalformed}}},
+		},
+		{
+			"[" + testJSONValueList + "," + broken + "]",
+			errQueueClosed,
+			http.StatusServiceUnavailable,
+			pushResponse{Rejected: []rejectedEntry{
+				{Index: 0, Identifier: "host1/load/load", Reason: rejectWriteFailed},
+				{Index: 1, Reason: rejectMalformed},
+			}},
+		},
+	} {
+		sink.err = tc.err
+		r := httptest.NewRequest("POST", "/collectd", strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		j.router.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("got status %d, expected %d", rec.Code, tc.status)
+		}
+		var got pushResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %s", rec.Body.String(), err)
+		}
+		for i := range got.Rejected {
+			got.Rejected[i].Error = ""
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("got %+v, expected %+v", got, tc.expected)
+		}
+	}
+	if n := testutil.ToFloat64(j.metrics.rejected.WithLabelValues("json", rejectMalformed)); n != 3 {
+		t.Errorf("got %v rejected value lists, expected 3", n)
+	}
+	if n := testutil.ToFloat64(j.metrics.rejected.WithLabelValues("json", rejectWriteFailed)); n != 1 {
+		t.Errorf("got %v value lists failing to be written, expected 1", n)
+	}
+}
+
+func TestHTTPPushWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	// the password of alice is "secret"
+	wc, err := loadWebConfig(writeTestFile(t, dir, "web.yml", `
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+basic_auth_users:
+  alice: $2a$10$jm25/cas2zMVWiw0QMYjiun39/jNtPY0BqkGadBMxNVZd0r1orBhS
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	j := &httpJSONCollector{sink: &recordingSink{}, metrics: newIngestMetrics(), web: func() *webConfig { return wc }}
+	tokens := writeTestFile(t, dir, "tokens", "agent: t0ken\n")
+	for _, tc := range []struct {
+		name, tokensFile, user, bearer string
+		status                         int
+	}{
+		{"anonymous", "", "", "", http.StatusUnauthorized},
+		{"web config user", "", "alice", "", http.StatusOK},
+		// the receiver users and tokens replace the web config ones
+		{"web config user, receiver tokens", tokens, "alice", "", http.StatusUnauthorized},
+		{"receiver token", tokens, "", "t0ken", http.StatusOK},
+	} {
+		if err := j.Configure(Config{CollectdJSONURLPath: "/collectd", CollectdJSONTokensFile: tc.tokensFile}); err != nil {
+			t.Fatalf("%s", err)
+		}
+		r := httptest.NewRequest("POST", "/collectd", strings.NewReader("["+testJSONValueList+"]"))
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, "secret")
+		}
+		if tc.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		rec := httptest.NewRecorder()
+		j.handler().ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d, expected %d", tc.name, rec.Code, tc.status)
+		}
+		if rec.Header().Get("X-Frame-Options") != "deny" {
+			t.Errorf("%s: missing header", tc.name)
+		}
+	}
+}
+
+func TestHTTPPushCommandStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "putval")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &recordingSink{}
+	j := &httpJSONCollector{sink: sink, metrics: newIngestMetrics()}
+	err = j.Configure(Config{
+		CollectdJSONURLPath: "/collectd",
+		CollectdTypesDBPath: writeTestFile(t, dir, "types.db", testTypesDB),
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{errQueueClosed, http.StatusServiceUnavailable},
+	} {
+		sink.err = tc.err
+		r := httptest.NewRequest("POST", "/collectd", strings.NewReader("PUTVAL host1/load/load 1500000000:0.1:0.2:0.3\n"))
+		r.Header.Set("Content-Type", contentTypeCommand)
+		rec := httptest.NewRecorder()
+		j.router.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%v: got status %d, expected %d", tc.err, rec.Code, tc.status)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%v: got body %q, expected none", tc.err, rec.Body.String())
+		}
+	}
+}
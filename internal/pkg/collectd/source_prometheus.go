@@ -1,35 +1,98 @@
 package collectd
 
 import (
-	"collectd.org/api"
+	"io"
+
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
 	"github.com/prometheus/client_golang/prometheus"
-	"log"
+	"github.com/prometheus/common/expfmt"
 )
 
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	for _, src := range c.srcs {
 		src.Describe(ch)
 	}
+	c.reload.Describe(ch)
+	c.queue.Describe(ch)
+	c.ingest.Describe(ch)
+	c.notifications.Describe(ch)
+	c.relayMetrics.Describe(ch)
+	c.store.Describe(ch)
 }
 
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, src := range c.srcs {
+		src.Collect(ch)
+	}
+	c.reload.Collect(ch)
+	c.queue.Collect(ch)
+	c.ingest.Collect(ch)
+	c.notifications.Collect(ch)
+	c.relayMetrics.Collect(ch)
+	c.collectValues(ch)
+
+	// after the conversions, to account for the failures of this round
+	c.store.Collect(ch)
+}
+
+// collectValues converts the values stored to metrics.
+func (c *Collector) collectValues(ch chan<- prometheus.Metric) {
 	c.rw.RLock()
-	values := make([]api.ValueList, 0, len(c.values))
-	for _, vl := range c.values {
-		values = append(values, vl)
+	values := make([]sample, 0, len(c.values))
+	for _, s := range c.values {
+		values = append(values, s)
 	}
+	conv := c.conv
 	c.rw.RUnlock()
 
-	for _, vl := range values {
+	for _, s := range values {
+		vl := s.vl
 		for i := range vl.Values {
-			m, err := c.conv.Convert(vl, i)
+			m, err := conv.ConvertWithMeta(vl, s.meta, i)
+			if err == nameconv.ErrDropped {
+				continue
+			}
 			if err != nil {
-				log.Printf("%s", err) // TODO
+				c.store.conversionFailures.Inc()
+				if c.debugLog != nil {
+					c.debugLog.Printf("Conversion failed: %s: %s", vl.Identifier.String(), err)
+				}
 				continue
 			}
 
 			ch <- m
 		}
 	}
+}
 
+// valuesCollector exposes the values stored by a Collector, without the
+// metrics about the exporter itself.
+type valuesCollector struct {
+	c *Collector
+}
+
+// Describe sends no descriptors: the metrics depend on the values received.
+func (v valuesCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (v valuesCollector) Collect(ch chan<- prometheus.Metric) {
+	v.c.collectValues(ch)
+}
+
+// DumpValues writes the values stored in the Prometheus text format,
+// without the metrics about the exporter itself.
+func (c *Collector) DumpValues(w io.Writer) error {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(valuesCollector{c}); err != nil {
+		return err
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,330 @@
+package collectd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const writePrometheusPrefix = "collectd_"
+
+// writePrometheusSource is a data source recovered from the name of a
+// metric family exposed by collectd write_prometheus.
+type writePrometheusSource struct {
+	plugin string
+	typ    string
+	dsname string
+	dstype reflect.Type
+}
+
+// parseWritePrometheusName reverses the write_prometheus naming scheme:
+//
+//	collectd_<plugin>[_<type>][_<dsname>][_total]
+//
+// where the type is omitted if equal to the plugin, the data source name
+// if equal to "value" and "_total" marks the counters and derives.
+// Since all the parts may contain underscores, the split is validated
+// against typesDB; plugin, if known from the labels, fixes the first part.
+func parseWritePrometheusName(name, plugin string, counter bool, typesDB *api.TypesDB) writePrometheusSource {
+	name = strings.TrimPrefix(name, writePrometheusPrefix)
+	if counter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '_' {
+			continue
+		}
+		p, rest := name[:i], ""
+		if i < len(name) {
+			rest = name[i+1:]
+		}
+		if p == "" || (plugin != "" && p != plugin) {
+			continue
+		}
+		if src, ok := lookupWritePrometheusType(p, rest, counter, typesDB); ok {
+			return src
+		}
+	}
+
+	// unknown type: assume a single "value" data source
+	src := writePrometheusSource{plugin: plugin, dsname: "value", dstype: gaugeType}
+	if counter {
+		src.dstype = deriveType
+	}
+	if plugin != "" {
+		src.typ = strings.TrimPrefix(strings.TrimPrefix(name, plugin), "_")
+	} else if i := strings.Index(name, "_"); i != -1 {
+		src.plugin, src.typ = name[:i], name[i+1:]
+	} else {
+		src.plugin = name
+	}
+	if src.typ == "" {
+		src.typ = src.plugin
+	}
+	return src
+}
+
+// lookupWritePrometheusType finds in typesDB the type and the data source
+// which, following plugin, are encoded in rest.
+func lookupWritePrometheusType(plugin, rest string, counter bool, typesDB *api.TypesDB) (writePrometheusSource, bool) {
+	if typesDB == nil {
+		return writePrometheusSource{}, false
+	}
+	candidates := [][2]string{{plugin, rest}, {rest, "value"}}
+	if rest == "" {
+		candidates = [][2]string{{plugin, "value"}}
+	}
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == '_' {
+			candidates = append(candidates, [2]string{rest[:i], rest[i+1:]})
+		}
+	}
+
+	for _, c := range candidates {
+		ds, ok := typesDB.DataSet(c[0])
+		if !ok {
+			continue
+		}
+		for _, src := range ds.Sources {
+			if src.Name != c[1] || (src.Type != gaugeType) != counter {
+				continue
+			}
+			return writePrometheusSource{plugin: plugin, typ: c[0], dsname: src.Name, dstype: src.Type}, true
+		}
+	}
+	return writePrometheusSource{}, false
+}
+
+// parseWritePrometheus rebuilds the value lists from the metric families
+// exposed by collectd write_prometheus. The "instance" label is the host;
+// the plugin instance is in the label named after the plugin and the type
+// instance in the "type" label. write_prometheus uses the plugin label
+// for the type instance when there is no plugin instance: the two cases
+// cannot be told apart, and the plugin instance is assumed.
+func parseWritePrometheus(families map[string]*dto.MetricFamily, typesDB *api.TypesDB, interval time.Duration, now time.Time) []*api.ValueList {
+	valueLists := make(map[api.Identifier]*api.ValueList)
+	var ids []api.Identifier
+
+	for name, family := range families {
+		if !strings.HasPrefix(name, writePrometheusPrefix) {
+			continue
+		}
+		counter := family.GetType() == dto.MetricType_COUNTER || strings.HasSuffix(name, "_total")
+
+		for _, m := range family.GetMetric() {
+			var id api.Identifier
+			var plugin, pluginInstance string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "instance":
+					id.Host = lp.GetValue()
+				case "type":
+					id.TypeInstance = lp.GetValue()
+				default:
+					plugin, pluginInstance = lp.GetName(), lp.GetValue()
+				}
+			}
+			if id.Host == "" {
+				continue
+			}
+
+			src := parseWritePrometheusName(name, plugin, counter, typesDB)
+			id.Plugin, id.PluginInstance, id.Type = src.plugin, pluginInstance, src.typ
+
+			var num float64
+			switch {
+			case m.Counter != nil:
+				num = m.Counter.GetValue()
+			case m.Gauge != nil:
+				num = m.Gauge.GetValue()
+			case m.Untyped != nil:
+				num = m.Untyped.GetValue()
+			default:
+				continue
+			}
+			var v api.Value = api.Gauge(num)
+			switch src.dstype {
+			case deriveType:
+				v = api.Derive(int64(num))
+			case counterType:
+				v = api.Counter(uint64(num))
+			}
+
+			vl, ok := valueLists[id]
+			if !ok {
+				vl = &api.ValueList{Identifier: id, Time: now, Interval: interval}
+				if m.TimestampMs != nil {
+					vl.Time = time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+				}
+				valueLists[id] = vl
+				ids = append(ids, id)
+			}
+			vl.Values = append(vl.Values, v)
+			vl.DSNames = append(vl.DSNames, src.dsname)
+		}
+	}
+
+	var result []*api.ValueList
+	for _, id := range ids {
+		result = append(result, sortDataSources(valueLists[id], typesDB))
+	}
+	return result
+}
+
+// sortDataSources puts the data sources of vl in the types.db order, or
+// else in the name order, the metric families being in no particular one.
+func sortDataSources(vl *api.ValueList, typesDB *api.TypesDB) *api.ValueList {
+	if len(vl.Values) < 2 {
+		return vl
+	}
+	var order []string
+	if typesDB != nil {
+		if ds, ok := typesDB.DataSet(vl.Type); ok {
+			for _, src := range ds.Sources {
+				order = append(order, src.Name)
+			}
+		}
+	}
+	if order == nil {
+		order = append(order, vl.DSNames...)
+		sort.Strings(order)
+	}
+
+	var values []api.Value
+	var names []string
+	for _, name := range order {
+		for i := range vl.DSNames {
+			if vl.DSNames[i] == name {
+				values = append(values, vl.Values[i])
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == len(vl.DSNames) {
+		vl.Values, vl.DSNames = values, names
+	}
+	return vl
+}
+
+// scrapeCollector periodically scrapes a collectd write_prometheus
+// endpoint, to remap its metrics.
+type scrapeCollector struct {
+	url        string
+	interval   time.Duration
+	client     *http.Client
+	sink       dataSink
+	typesDB    atomic.Value // *api.TypesDB
+	metrics    *ingestMetrics
+	lastUpdate prometheus.Gauge
+}
+
+func (s *scrapeCollector) Configure(conf Config) error {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return err
+	}
+	s.typesDB.Store(typesDB)
+
+	s.interval = conf.CollectdScrapeInterval
+	if s.interval <= 0 {
+		return fmt.Errorf("Invalid scrape interval: %s", s.interval)
+	}
+	s.client = &http.Client{Timeout: s.interval}
+
+	s.lastUpdate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "collectd_update_scrape_timestamp_seconds",
+			Help: "Unix timestamp of the last successful collectd write_prometheus scrape in seconds.",
+		},
+	)
+
+	return nil
+}
+
+// PrepareReload re-reads types.db, used to recover the data source types.
+func (s *scrapeCollector) PrepareReload(conf Config) (func(), error) {
+	typesDB, err := loadTypesDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func() { s.typesDB.Store(typesDB) }, nil
+}
+
+func (s *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.lastUpdate.Desc()
+}
+
+func (s *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- s.lastUpdate
+}
+
+func (s *scrapeCollector) Run(ctx context.Context) error {
+	log.Printf("CollectD starting scraper: '%s' every %s", s.url, s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.scrape(ctx); err != nil {
+			log.Printf("CollectD scrape failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("CollectD stopped scraper")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *scrapeCollector) scrape(ctx context.Context) error {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	s.metrics.received.WithLabelValues("scrape").Inc()
+
+	valueLists, err := s.parse(resp.Body, time.Now())
+	if err != nil {
+		s.metrics.decodeFailures.WithLabelValues("scrape").Inc()
+		return err
+	}
+	s.metrics.decoded.WithLabelValues("scrape").Add(float64(len(valueLists)))
+	s.lastUpdate.SetToCurrentTime()
+
+	for _, vl := range valueLists {
+		s.sink.Write(ctx, vl)
+	}
+	return nil
+}
+
+func (s *scrapeCollector) parse(r io.Reader, now time.Time) ([]*api.ValueList, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+	typesDB := s.typesDB.Load().(*api.TypesDB)
+	return parseWritePrometheus(families, typesDB, s.interval, now), nil
+}
@@ -0,0 +1,129 @@
+package collectd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+const testWritePrometheus = `# HELP collectd_load_shortterm write_prometheus plugin: 'load' Type: 'load', Dstype: 'gauge', Dsname: 'shortterm'
+# TYPE collectd_load_shortterm gauge
+collectd_load_shortterm{instance="h1"} 0.1 1500000010500
+# TYPE collectd_load_longterm gauge
+collectd_load_longterm{instance="h1"} 0.3 1500000010500
+# TYPE collectd_load_midterm gauge
+collectd_load_midterm{instance="h1"} 0.2 1500000010500
+# TYPE collectd_interface_if_octets_tx_total counter
+collectd_interface_if_octets_tx_total{interface="eth0",instance="h1"} 200 1500000020000
+# TYPE collectd_interface_if_octets_rx_total counter
+collectd_interface_if_octets_rx_total{interface="eth0",instance="h1"} 100 1500000020000
+# TYPE collectd_my_plugin_counter_total counter
+collectd_my_plugin_counter_total{my_plugin="a",type="b",instance="h2"} 42
+# TYPE collectd_virt_vcpu_total counter
+collectd_virt_vcpu_total{virt="dom1",type="0",instance="h2"} 7
+# TYPE go_goroutines gauge
+go_goroutines 8
+`
+
+func TestScrapeWritePrometheus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testWritePrometheus)
+	}))
+	defer ts.Close()
+
+	sink := &recordingSink{}
+	s := &scrapeCollector{
+		url:     ts.URL,
+		sink:    sink,
+		metrics: newIngestMetrics(),
+	}
+	if err := s.Configure(Config{CollectdScrapeInterval: 10 * time.Second}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	s.typesDB.Store(newTestTypesDB(t))
+
+	if err := s.scrape(context.Background()); err != nil {
+		t.Fatalf("%s", err)
+	}
+	got := make(map[api.Identifier]*api.ValueList)
+	for _, vl := range sink.valueLists {
+		got[vl.Identifier] = vl
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d value lists, expected 4", len(got))
+	}
+
+	load := got[api.Identifier{Host: "h1", Plugin: "load", Type: "load"}]
+	if load == nil {
+		t.Fatalf("missing load in %v", got)
+	}
+	if !reflect.DeepEqual(load.DSNames, []string{"shortterm", "midterm", "longterm"}) {
+		t.Errorf("dsnames: got %v", load.DSNames)
+	}
+	if !reflect.DeepEqual(load.Values, []api.Value{api.Gauge(0.1), api.Gauge(0.2), api.Gauge(0.3)}) {
+		t.Errorf("values: got %v", load.Values)
+	}
+	if !load.Time.Equal(time.Unix(1500000010, 500000000)) || load.Interval != 10*time.Second {
+		t.Errorf("time/interval: got %v/%v", load.Time, load.Interval)
+	}
+
+	iface := got[api.Identifier{Host: "h1", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}]
+	if iface == nil || !reflect.DeepEqual(iface.Values, []api.Value{api.Derive(100), api.Derive(200)}) {
+		t.Errorf("if_octets: got %v", iface)
+	}
+
+	counter := got[api.Identifier{Host: "h2", Plugin: "my_plugin", PluginInstance: "a", Type: "counter", TypeInstance: "b"}]
+	if counter == nil || !reflect.DeepEqual(counter.Values, []api.Value{api.Counter(42)}) {
+		t.Errorf("counter: got %v", counter)
+	}
+
+	// not in types.db: a single derive named "value"
+	vcpu := got[api.Identifier{Host: "h2", Plugin: "virt", PluginInstance: "dom1", Type: "vcpu", TypeInstance: "0"}]
+	if vcpu == nil || !reflect.DeepEqual(vcpu.Values, []api.Value{api.Derive(7)}) || vcpu.DSNames[0] != "value" {
+		t.Errorf("vcpu: got %v", vcpu)
+	}
+}
+
+func TestParseWritePrometheusName(t *testing.T) {
+	typesDB := newTestTypesDB(t)
+	testCases := []struct {
+		name     string
+		plugin   string
+		counter  bool
+		expected writePrometheusSource
+	}{
+		{"collectd_load_midterm", "", false, writePrometheusSource{"load", "load", "midterm", gaugeType}},
+		{"collectd_interface_if_octets_rx_total", "", true, writePrometheusSource{"interface", "if_octets", "rx", deriveType}},
+		{"collectd_my_plugin_counter_total", "my_plugin", true, writePrometheusSource{"my_plugin", "counter", "value", counterType}},
+		{"collectd_cpu_percent", "", false, writePrometheusSource{"cpu", "percent", "value", gaugeType}},
+		{"collectd_uptime", "", false, writePrometheusSource{"uptime", "uptime", "value", gaugeType}},
+		{"collectd_my_plugin", "my_plugin", false, writePrometheusSource{"my_plugin", "my_plugin", "value", gaugeType}},
+	}
+	for _, tc := range testCases {
+		got := parseWritePrometheusName(tc.name, tc.plugin, tc.counter, typesDB)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestScrapeBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	s := &scrapeCollector{url: ts.URL, sink: &recordingSink{}, metrics: newIngestMetrics()}
+	s.Configure(Config{CollectdScrapeInterval: time.Second})
+	err := s.scrape(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, expected a 503 error", err)
+	}
+}
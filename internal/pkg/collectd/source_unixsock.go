@@ -0,0 +1,239 @@
+package collectd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unixsockClient speaks the collectd unixsock plugin protocol.
+type unixsockClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// unixsockError is an error status returned by collectd for a command.
+type unixsockError struct {
+	cmd    string
+	status string
+}
+
+func (e *unixsockError) Error() string {
+	return fmt.Sprintf("%s: %s", e.cmd, e.status)
+}
+
+type listvalEntry struct {
+	time time.Time
+	id   string
+}
+
+func (u *unixsockClient) command(cmd string) ([]string, error) {
+	if _, err := fmt.Fprintf(u.conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	status, err := u.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status = strings.TrimSpace(status)
+	fields := strings.SplitN(status, " ", 2)
+	count, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad status line '%s'", status)
+	}
+	if count < 0 {
+		return nil, &unixsockError{cmd: cmd, status: status}
+	}
+	lines := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := u.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+	return lines, nil
+}
+
+func (u *unixsockClient) listval() ([]listvalEntry, error) {
+	lines, err := u.command("LISTVAL")
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]listvalEntry, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad LISTVAL line '%s'", line)
+		}
+		secs, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad LISTVAL time '%s'", fields[0])
+		}
+		entries = append(entries, listvalEntry{
+			time: time.Unix(0, int64(secs*float64(time.Second))),
+			id:   fields[1],
+		})
+	}
+	return entries, nil
+}
+
+// getval returns the data source names and the values of id.
+func (u *unixsockClient) getval(id string) ([]string, []string, error) {
+	quoted := strings.Replace(strings.Replace(id, `\`, `\\`, -1), `"`, `\"`, -1)
+	lines, err := u.command(`GETVAL "` + quoted + `"`)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names, values []string
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("bad GETVAL line '%s'", line)
+		}
+		names = append(names, kv[0])
+		values = append(values, kv[1])
+	}
+	return names, values, nil
+}
+
+// unixsockValueList builds the value list of id from a GETVAL answer.
+// GETVAL returns rates for the DERIVE and COUNTER data sources, so all
+// the values are gauges.
+func unixsockValueList(entry listvalEntry, names, values []string, interval time.Duration) (*api.ValueList, error) {
+	id, err := api.ParseIdentifier(entry.id)
+	if err != nil {
+		return nil, err
+	}
+	vl := &api.ValueList{
+		Identifier: id,
+		Time:       entry.time,
+		Interval:   interval,
+		DSNames:    names,
+	}
+
+	for _, raw := range values {
+		num, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			if strings.EqualFold(raw, "nan") {
+				num = math.NaN()
+			} else {
+				return nil, fmt.Errorf("%s: bad value '%s'", entry.id, raw)
+			}
+		}
+		vl.Values = append(vl.Values, api.Gauge(num))
+	}
+	return vl, nil
+}
+
+// unixsockCollector periodically polls the collectd unixsock plugin,
+// for the hosts which have no network output configured.
+type unixsockCollector struct {
+	path       string
+	interval   time.Duration
+	sink       dataSink
+	lastSeen   map[string]time.Time
+	metrics    *ingestMetrics
+	lastUpdate prometheus.Gauge
+}
+
+func (u *unixsockCollector) Configure(conf Config) error {
+	u.interval = conf.CollectdUnixsockInterval
+	if u.interval <= 0 {
+		return fmt.Errorf("Invalid unixsock poll interval: %s", u.interval)
+	}
+	u.lastSeen = make(map[string]time.Time)
+
+	u.lastUpdate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "collectd_update_unixsock_timestamp_seconds",
+			Help: "Unix timestamp of the last successful collectd unixsock poll in seconds.",
+		},
+	)
+
+	return nil
+}
+
+func (u *unixsockCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- u.lastUpdate.Desc()
+}
+
+func (u *unixsockCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- u.lastUpdate
+}
+
+func (u *unixsockCollector) Run(ctx context.Context) error {
+	log.Printf("CollectD starting poller: unixsock '%s' every %s", u.path, u.interval)
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		if err := u.poll(ctx); err != nil {
+			log.Printf("CollectD unixsock poll failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("CollectD stopped poller: unixsock")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches the values updated since the last poll.
+func (u *unixsockCollector) poll(ctx context.Context) error {
+	conn, err := net.DialTimeout("unix", u.path, u.interval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(u.interval))
+	u.metrics.received.WithLabelValues("unixsock").Inc()
+
+	client := &unixsockClient{conn: conn, r: bufio.NewReader(conn)}
+	entries, err := client.listval()
+	if err != nil {
+		u.metrics.decodeFailures.WithLabelValues("unixsock").Inc()
+		return err
+	}
+
+	seen := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		seen[entry.id] = entry.time
+		if last, ok := u.lastSeen[entry.id]; ok && !entry.time.After(last) {
+			continue
+		}
+
+		names, values, err := client.getval(entry.id)
+		if _, ok := err.(*unixsockError); ok {
+			// e.g. the value expired since LISTVAL: retried next time
+			u.metrics.decodeFailures.WithLabelValues("unixsock").Inc()
+			log.Printf("CollectD unixsock: %s", err)
+			delete(seen, entry.id)
+			continue
+		} else if err != nil {
+			u.metrics.decodeFailures.WithLabelValues("unixsock").Inc()
+			return err
+		}
+		vl, err := unixsockValueList(entry, names, values, u.interval)
+		if err != nil {
+			u.metrics.decodeFailures.WithLabelValues("unixsock").Inc()
+			log.Printf("CollectD unixsock: %s", err)
+			continue
+		}
+		u.metrics.decoded.WithLabelValues("unixsock").Inc()
+		u.sink.Write(ctx, vl)
+	}
+	u.lastSeen = seen
+	u.lastUpdate.SetToCurrentTime()
+	return nil
+}
@@ -0,0 +1,185 @@
+package collectd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/fromanirh/virt-collectd-exporter/pkg/nameconv"
+)
+
+// fakeUnixsock answers LISTVAL and GETVAL like the collectd unixsock plugin.
+type fakeUnixsock struct {
+	lock    sync.Mutex
+	times   map[string]string
+	values  map[string][]string
+	getvals int
+}
+
+func (f *fakeUnixsock) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeUnixsock) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields, err := splitCommand(scanner.Text())
+		if err != nil || len(fields) == 0 {
+			fmt.Fprintf(conn, "-1 Unknown command\n")
+			continue
+		}
+		f.lock.Lock()
+		switch {
+		case fields[0] == "LISTVAL":
+			fmt.Fprintf(conn, "%d Values found\n", len(f.times))
+			for id, ts := range f.times {
+				fmt.Fprintf(conn, "%s %s\n", ts, id)
+			}
+		case fields[0] == "GETVAL" && len(fields) == 2:
+			f.getvals++
+			values, ok := f.values[fields[1]]
+			if !ok {
+				fmt.Fprintf(conn, "-1 No such value\n")
+				break
+			}
+			fmt.Fprintf(conn, "%d Values found\n", len(values))
+			for _, v := range values {
+				fmt.Fprintf(conn, "%s\n", v)
+			}
+		default:
+			fmt.Fprintf(conn, "-1 Unknown command\n")
+		}
+		f.lock.Unlock()
+	}
+}
+
+type recordingSink struct {
+	valueLists []*api.ValueList
+	err        error
+}
+
+func (r *recordingSink) Write(ctx context.Context, vl *api.ValueList) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.valueLists = append(r.valueLists, vl)
+	return nil
+}
+
+func (r *recordingSink) WriteMeta(ctx context.Context, vl *api.ValueList, meta nameconv.Meta) error {
+	return r.Write(ctx, vl)
+}
+
+func TestUnixsockPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixsock")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "collectd.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer l.Close()
+	fake := &fakeUnixsock{
+		times: map[string]string{
+			"host 1/load/load":               "1500000010.500",
+			"host2/interface-eth0/if_octets": "1500000020.000",
+		},
+		values: map[string][]string{
+			"host 1/load/load":               {"shortterm=1.000000e-01", "midterm=nan", "longterm=3.000000e-01"},
+			"host2/interface-eth0/if_octets": {"rx=100", "tx=200"},
+		},
+	}
+	go fake.serve(l)
+
+	sink := &recordingSink{}
+	u := &unixsockCollector{
+		path:    path,
+		sink:    sink,
+		metrics: newIngestMetrics(),
+	}
+	u.Configure(Config{CollectdUnixsockInterval: 10 * time.Second})
+
+	if err := u.poll(context.Background()); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(sink.valueLists) != 2 {
+		t.Fatalf("got %d value lists, expected 2", len(sink.valueLists))
+	}
+	got := make(map[string]*api.ValueList)
+	for _, vl := range sink.valueLists {
+		got[vl.Identifier.String()] = vl
+	}
+
+	load := got["host 1/load/load"]
+	if load == nil || !load.Time.Equal(time.Unix(1500000010, 500000000)) || load.Interval != 10*time.Second {
+		t.Fatalf("load: got %v", load)
+	}
+	if !reflect.DeepEqual(load.DSNames, []string{"shortterm", "midterm", "longterm"}) {
+		t.Errorf("dsnames: got %v", load.DSNames)
+	}
+	if load.Values[0] != api.Gauge(0.1) || load.Values[2] != api.Gauge(0.3) {
+		t.Errorf("values: got %v", load.Values)
+	}
+
+	iface := got["host2/interface-eth0/if_octets"]
+	// GETVAL returns rates, kept as gauges
+	if iface == nil || !reflect.DeepEqual(iface.Values, []api.Value{api.Gauge(100), api.Gauge(200)}) {
+		t.Fatalf("if_octets: got %v", iface)
+	}
+
+	// unchanged values are not fetched again
+	fake.lock.Lock()
+	fake.getvals = 0
+	fake.times["host2/interface-eth0/if_octets"] = "1500000030.000"
+	fake.lock.Unlock()
+	sink.valueLists = nil
+	if err := u.poll(context.Background()); err != nil {
+		t.Fatalf("%s", err)
+	}
+	fake.lock.Lock()
+	getvals := fake.getvals
+	fake.lock.Unlock()
+	if len(sink.valueLists) != 1 || getvals != 1 {
+		t.Fatalf("got %d value lists with %d GETVAL, expected 1", len(sink.valueLists), getvals)
+	}
+	if !strings.HasPrefix(sink.valueLists[0].Identifier.String(), "host2/") {
+		t.Errorf("got %v", sink.valueLists[0].Identifier)
+	}
+
+	// a failed GETVAL skips the value only
+	fake.lock.Lock()
+	fake.times["host3/cpu/cpu"] = "1500000030.000"
+	fake.times["host2/interface-eth0/if_octets"] = "1500000040.000"
+	fake.lock.Unlock()
+	sink.valueLists = nil
+	if err := u.poll(context.Background()); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(sink.valueLists) != 1 {
+		t.Errorf("got %d value lists, expected the one still there", len(sink.valueLists))
+	}
+	if _, ok := u.lastSeen["host3/cpu/cpu"]; ok {
+		t.Errorf("the missing value would not be retried")
+	}
+}
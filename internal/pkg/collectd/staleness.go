@@ -0,0 +1,106 @@
+package collectd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+)
+
+// DefaultStalenessIntervals is the number of intervals after which a
+// series is stale, as the collectd Timeout default.
+const DefaultStalenessIntervals = 2
+
+const (
+	// minPurgeInterval and maxPurgeInterval bound how often the expired
+	// series are purged; maxPurgeInterval is also used while nothing is
+	// stored.
+	minPurgeInterval = time.Second
+	maxPurgeInterval = time.Minute
+	// stoppedDomainRetention is how long the samples older than the stop
+	// of a virt domain are rejected, in case they were still queued.
+	stoppedDomainRetention = time.Hour
+)
+
+// stoppedDomainStates are the states, as reported by the collectd virt
+// plugin notifications ("Domain state: <state>. Reason: <reason>"), of a
+// domain which is not going to report again.
+var stoppedDomainStates = []string{"domain is shut off", "domain is crashed"}
+
+// stalenessPolicy tells when a series expires: a number of intervals
+// after its last value list, by default or for a given plugin.
+type stalenessPolicy struct {
+	intervals float64
+	plugins   map[string]float64
+}
+
+// parseStalenessPolicy reads the policy from conf, with the plugin
+// overrides in the form "plugin=intervals".
+func parseStalenessPolicy(conf Config) (stalenessPolicy, error) {
+	p := stalenessPolicy{
+		intervals: conf.StalenessIntervals,
+		plugins:   make(map[string]float64),
+	}
+	if p.intervals == 0 {
+		p.intervals = DefaultStalenessIntervals
+	} else if p.intervals < 0 {
+		return p, fmt.Errorf("Invalid staleness intervals: %v", conf.StalenessIntervals)
+	}
+	for _, spec := range conf.StalenessPlugins {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return p, fmt.Errorf("Invalid staleness override: '%s': expected plugin=intervals", spec)
+		}
+		intervals, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || intervals <= 0 {
+			return p, fmt.Errorf("Invalid staleness override: '%s': bad intervals '%s'", spec, kv[1])
+		}
+		p.plugins[strings.TrimSpace(kv[0])] = intervals
+	}
+	return p, nil
+}
+
+// expiration returns the time after which vl is stale.
+func (p stalenessPolicy) expiration(vl *api.ValueList) time.Time {
+	intervals, ok := p.plugins[vl.Plugin]
+	if !ok {
+		intervals = p.intervals
+	}
+	return vl.Time.Add(time.Duration(intervals * float64(vl.Interval)))
+}
+
+// purgeInterval returns how often to purge, given the smallest interval
+// of the stored series (0 if none).
+func purgeInterval(smallest time.Duration) time.Duration {
+	switch {
+	case smallest <= 0 || smallest > maxPurgeInterval:
+		return maxPurgeInterval
+	case smallest < minPurgeInterval:
+		return minPurgeInterval
+	}
+	return smallest
+}
+
+// domainKey identifies a virt domain: depending on its HostnameFormat and
+// PluginInstanceFormat, the collectd virt plugin reports the values of a
+// domain with its name as host, as plugin instance, or both.
+func domainKey(host, domain string) string {
+	return host + "/" + domain
+}
+
+// stoppedDomain returns the key of the virt domain n reports as stopped,
+// if it does.
+func stoppedDomain(n *notification) (string, bool) {
+	if n.Plugin != "virt" {
+		return "", false
+	}
+	msg := strings.ToLower(n.Message)
+	for _, state := range stoppedDomainStates {
+		if strings.Contains(msg, state) {
+			return domainKey(n.Host, n.PluginInstance), true
+		}
+	}
+	return "", false
+}
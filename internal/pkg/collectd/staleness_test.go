@@ -0,0 +1,100 @@
+package collectd
+
+import (
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestStalenessPolicy(t *testing.T) {
+	p, err := parseStalenessPolicy(Config{StalenessPlugins: []string{"virt=4", "df=1.5"}})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	last := time.Unix(1500000000, 0)
+	for plugin, expected := range map[string]time.Duration{
+		"load": 20 * time.Second,
+		"virt": 40 * time.Second,
+		"df":   15 * time.Second,
+	} {
+		vl := &api.ValueList{
+			Identifier: api.Identifier{Host: "host1", Plugin: plugin},
+			Time:       last,
+			Interval:   10 * time.Second,
+		}
+		if got := p.expiration(vl).Sub(last); got != expected {
+			t.Errorf("%s: expires after %s, expected %s", plugin, got, expected)
+		}
+	}
+
+	for _, conf := range []Config{
+		{StalenessIntervals: -1},
+		{StalenessPlugins: []string{"virt"}},
+		{StalenessPlugins: []string{"=2"}},
+		{StalenessPlugins: []string{"virt=0"}},
+		{StalenessPlugins: []string{"virt=often"}},
+	} {
+		if _, err := parseStalenessPolicy(conf); err == nil {
+			t.Errorf("%+v: unexpected success", conf)
+		}
+	}
+}
+
+func TestPurgeInterval(t *testing.T) {
+	for smallest, expected := range map[time.Duration]time.Duration{
+		0:                      maxPurgeInterval,
+		10 * time.Millisecond:  minPurgeInterval,
+		10 * time.Second:       10 * time.Second,
+		5 * time.Minute:        maxPurgeInterval,
+		maxPurgeInterval + 1:   maxPurgeInterval,
+		minPurgeInterval - 1:   minPurgeInterval,
+		minPurgeInterval + 100: minPurgeInterval + 100,
+	} {
+		if got := purgeInterval(smallest); got != expected {
+			t.Errorf("%s: got %s, expected %s", smallest, got, expected)
+		}
+	}
+}
+
+func TestStoppedDomain(t *testing.T) {
+	for _, tc := range []struct {
+		n       notification
+		key     string
+		stopped bool
+	}{
+		{
+			notification{
+				Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom1", Type: "domain_state"},
+				Message:    "Domain state: the domain is shut off. Reason: normal shutdown",
+			},
+			"hv1/dom1", true,
+		},
+		{
+			notification{
+				Identifier: api.Identifier{Host: "dom1", Plugin: "virt", Type: "domain_state"},
+				Message:    "Domain state: the domain is crashed. Reason: unknown",
+			},
+			"dom1/", true,
+		},
+		{
+			notification{
+				Identifier: api.Identifier{Host: "hv1", Plugin: "virt", PluginInstance: "dom1", Type: "domain_state"},
+				Message:    "Domain state: the domain is running. Reason: crashed",
+			},
+			"", false,
+		},
+		{
+			notification{
+				Identifier: api.Identifier{Host: "hv1", Plugin: "threshold", PluginInstance: "dom1"},
+				Message:    "the domain is shut off",
+			},
+			"", false,
+		},
+	} {
+		key, stopped := stoppedDomain(&tc.n)
+		if key != tc.key || stopped != tc.stopped {
+			t.Errorf("%q: got %q %v, expected %q %v", tc.n.Message, key, stopped, tc.key, tc.stopped)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package collectd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the web configuration file of the Prometheus
+// exporter-toolkit, see
+// https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+type webConfig struct {
+	TLSServerConfig  *webTLSConfig     `yaml:"tls_server_config"`
+	HTTPServerConfig webHTTPConfig     `yaml:"http_server_config"`
+	Users            map[string]string `yaml:"basic_auth_users"`
+
+	tls *tls.Config
+
+	// cache of the successful password checks, bcrypt being slow by design
+	lock  sync.Mutex
+	valid map[[sha256.Size]byte]bool
+}
+
+type webTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuthType           string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type webHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+const webPasswordCacheSize = 100
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+	tlsClientAuthTypes = map[string]tls.ClientAuthType{
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+)
+
+// loadWebConfig reads and validates a web configuration file. The relative
+// paths in the file are relative to its directory. An empty filename gives
+// the default configuration: plain HTTP and no authentication.
+func loadWebConfig(filename string) (*webConfig, error) {
+	w := &webConfig{valid: make(map[[sha256.Size]byte]bool)}
+	if filename == "" {
+		return w, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, w); err != nil {
+		return nil, fmt.Errorf("Invalid web config file '%s': %s", filename, err)
+	}
+	for user, hash := range w.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("Invalid web config file '%s': user '%s': %s", filename, user, err)
+		}
+	}
+	if w.TLSServerConfig != nil {
+		w.tls, err = w.TLSServerConfig.build(filepath.Dir(filename))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid web config file '%s': %s", filename, err)
+		}
+		w.tls.NextProtos = []string{"http/1.1"}
+		if w.http2() {
+			w.tls.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	log.Printf("Web config file: '%s'", filename)
+	return w, nil
+}
+
+func (t *webTLSConfig) build(dir string) (*tls.Config, error) {
+	if t.CertFile == "" {
+		return nil, errors.New("missing cert_file")
+	}
+	if t.KeyFile == "" {
+		return nil, errors.New("missing key_file")
+	}
+	cert, err := tls.LoadX509KeyPair(relativeTo(dir, t.CertFile), relativeTo(dir, t.KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: t.PreferServerCipherSuites,
+	}
+
+	if t.MinVersion != "" {
+		if config.MinVersion, err = parseTLSVersion(t.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if t.MaxVersion != "" {
+		if config.MaxVersion, err = parseTLSVersion(t.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range t.CipherSuites {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	for _, name := range t.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve '%s'", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if t.ClientAuthType != "" {
+		var ok bool
+		if config.ClientAuth, ok = tlsClientAuthTypes[t.ClientAuthType]; !ok {
+			return nil, fmt.Errorf("unknown client_auth_type '%s'", t.ClientAuthType)
+		}
+	}
+	if t.ClientCAFile != "" {
+		if config.ClientAuth == tls.NoClientCert {
+			return nil, errors.New("client_ca_file set without client_auth_type")
+		}
+		data, err := ioutil.ReadFile(relativeTo(dir, t.ClientCAFile))
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in '%s'", t.ClientCAFile)
+		}
+	} else if config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type '%s' requires client_ca_file", t.ClientAuthType)
+	}
+	return config, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version '%s'", s)
+}
+
+func parseCipherSuite(s string) (uint16, error) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == s {
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite '%s'", s)
+}
+
+func relativeTo(dir, filename string) string {
+	if filename == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(dir, filename)
+}
+
+func (w *webConfig) http2() bool {
+	return w.HTTPServerConfig.HTTP2 == nil || *w.HTTPServerConfig.HTTP2
+}
+
+// checkPassword tells if password matches the bcrypt hash of user.
+func (w *webConfig) checkPassword(user, password string) bool {
+	hash, known := w.Users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	w.lock.Lock()
+	valid := w.valid[key]
+	w.lock.Unlock()
+	if valid {
+		return true
+	}
+
+	if !known {
+		// check anyway, not to tell the known users apart by timing
+		bcrypt.CompareHashAndPassword(webDummyHash, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	w.lock.Lock()
+	if len(w.valid) >= webPasswordCacheSize {
+		w.valid = make(map[[sha256.Size]byte]bool)
+	}
+	w.valid[key] = true
+	w.lock.Unlock()
+	return true
+}
+
+// webDummyHash is the bcrypt hash checked for the unknown users.
+var webDummyHash = []byte("$2a$10$MFgE0yS5Un6rpQmK3mu.oeVLwAZSuLkufmnz5a2IhnYO0yvVlWpB6")
+
+// webHandler enforces the web configuration returned by config on inner:
+// basic auth and the extra response headers. The basic auth is left to
+// inner while ownAuth, if not nil, returns true.
+func webHandler(config func() *webConfig, ownAuth func() bool, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wc := config()
+		for k, v := range wc.HTTPServerConfig.Headers {
+			w.Header().Set(k, v)
+		}
+		if len(wc.Users) > 0 && (ownAuth == nil || !ownAuth()) {
+			user, password, ok := r.BasicAuth()
+			if !ok || !wc.checkPassword(user, password) {
+				w.Header().Set("WWW-Authenticate", "Basic")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// setupWebServer enables TLS and HTTP/2 on srv as the web configuration
+// returned by config asks. TLS cannot be turned on or off once srv is
+// serving, but the certificates and the TLS settings are picked from the
+// current configuration on every handshake.
+func setupWebServer(srv *http.Server, config func() *webConfig) {
+	wc := config()
+	if wc.tls == nil {
+		return
+	}
+	srv.TLSConfig = &tls.Config{
+		NextProtos: wc.tls.NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if current := config().tls; current != nil {
+				return current, nil
+			}
+			return wc.tls, nil
+		},
+	}
+	if !wc.http2() {
+		// a non-nil map disables HTTP/2
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+}
+
+func (c *Collector) webConfig() *webConfig {
+	return c.web.Load().(*webConfig)
+}
@@ -0,0 +1,124 @@
+package collectd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost and its key
+// as cert.pem and key.pem in dir.
+func writeTestCert(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	writeTestFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTestFile(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+}
+
+func TestWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir)
+
+	// the password of alice is "secret"
+	wc, err := loadWebConfig(writeTestFile(t, dir, "web.yml", `
+tls_server_config:
+  cert_file: cert.pem
+  key_file: key.pem
+  min_version: TLS13
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+basic_auth_users:
+  alice: $2a$10$jm25/cas2zMVWiw0QMYjiun39/jNtPY0BqkGadBMxNVZd0r1orBhS
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if wc.tls == nil || wc.tls.MinVersion != tls.VersionTLS13 {
+		t.Errorf("got TLS config %+v", wc.tls)
+	}
+
+	handler := webHandler(func() *webConfig { return wc }, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv := httptest.NewUnstartedServer(handler)
+	setupWebServer(srv.Config, func() *webConfig { return wc })
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, tc := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusUnauthorized},
+		{"alice", "secret", http.StatusOK},
+		{"alice", "secret", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s:%s: got status %d, expected %d", tc.user, tc.password, resp.StatusCode, tc.status)
+		}
+		if resp.Header.Get("X-Frame-Options") != "deny" {
+			t.Errorf("%s:%s: missing header", tc.user, tc.password)
+		}
+		if resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+			t.Errorf("%s:%s: got TLS state %+v", tc.user, tc.password, resp.TLS)
+		}
+	}
+
+	invalid := []string{
+		"basic_auth_users:\n  alice: secret\n",
+		"tls_server_config:\n  key_file: key.pem\n",
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  min_version: SSL3\n",
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  client_auth_type: RequireAndVerifyClientCert\n",
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  client_ca_file: cert.pem\n",
+		"tls_config:\n  cert_file: cert.pem\n",
+	}
+	for _, content := range invalid {
+		if _, err := loadWebConfig(writeTestFile(t, dir, "bad.yml", content)); err == nil {
+			t.Errorf("%q: unexpected success", content)
+		}
+	}
+}
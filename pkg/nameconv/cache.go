@@ -0,0 +1,73 @@
+package nameconv
+
+import (
+	"sync"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type descEntry struct {
+	dstype string
+	meta   string
+	desc   *prometheus.Desc
+	err    error
+}
+
+// descCache holds the descriptors already computed, keyed by identifier
+// and data source index. The data source type is part of the help text,
+// and the meta data may be part of the labels, so both are checked on
+// lookup: a change replaces the entry, so that a series whose meta data
+// keep changing does not grow the cache.
+type descCache struct {
+	rw      sync.RWMutex
+	entries map[api.Identifier]map[int]descEntry
+}
+
+func newDescCache() *descCache {
+	return &descCache{
+		entries: make(map[api.Identifier]map[int]descEntry),
+	}
+}
+
+func (c *descCache) get(id api.Identifier, index int, dstype, meta string) (descEntry, bool) {
+	c.rw.RLock()
+	entry, ok := c.entries[id][index]
+	c.rw.RUnlock()
+	if !ok || entry.dstype != dstype || entry.meta != meta {
+		return descEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *descCache) put(id api.Identifier, index int, dstype, meta string, desc *prometheus.Desc, err error) {
+	c.rw.Lock()
+	entries, ok := c.entries[id]
+	if !ok {
+		entries = make(map[int]descEntry)
+		c.entries[id] = entries
+	}
+	entries[index] = descEntry{
+		dstype: dstype,
+		meta:   meta,
+		desc:   desc,
+		err:    err,
+	}
+	c.rw.Unlock()
+}
+
+func (c *descCache) forget(id api.Identifier) {
+	c.rw.Lock()
+	delete(c.entries, id)
+	c.rw.Unlock()
+}
+
+func (c *descCache) len() int {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	n := 0
+	for _, entries := range c.entries {
+		n += len(entries)
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package nameconv
+
+import (
+	"fmt"
+	"testing"
+
+	"collectd.org/api"
+)
+
+const benchDomains = 500
+
+var benchConf = []byte(`{
+	"source": "virt",
+	"prefix": "vce",
+	"labels": {
+		"*": [{"label": "instance", "ident": "$Host"}],
+		"virt": [{"label": "domain", "ident": "$Host"}, {"label": "vcpu", "ident": "$TypeInstance"}]
+	},
+	"rules": [
+		{"plugin": "virt", "type": "/^if_/", "name": "vm_network_{{.Type}}_{{.DSName}}"},
+		{"plugin": "virt", "name": "vm_{{.Type}}_{{.DSName}}"}
+	]
+}`)
+
+func benchValueLists() []api.ValueList {
+	var vls []api.ValueList
+	for i := 0; i < benchDomains; i++ {
+		host := fmt.Sprintf("vm%04d", i)
+		vls = append(vls,
+			api.ValueList{
+				Identifier: api.Identifier{Host: host, Plugin: "virt", Type: "virt_vcpu", TypeInstance: "0"},
+				DSNames:    []string{"value"},
+				Values:     []api.Value{api.Derive(i)},
+			},
+			api.ValueList{
+				Identifier: api.Identifier{Host: host, Plugin: "virt", Type: "if_octets", TypeInstance: "vnet0"},
+				DSNames:    []string{"rx", "tx"},
+				Values:     []api.Value{api.Derive(i), api.Derive(i)},
+			},
+		)
+	}
+	return vls
+}
+
+func TestNameConverterCache(t *testing.T) {
+	nc, err := NewNameConverterWithJSON(benchConf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	vl := benchValueLists()[1]
+
+	first, err := nc.Describe(vl, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	second, err := nc.Describe(vl, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if first != second {
+		t.Errorf("Describe(%v): descriptor not cached", vl)
+	}
+	if n := nc.cache.len(); n != 1 {
+		t.Errorf("cache size: got %d, expected 1", n)
+	}
+
+	vl.Values = []api.Value{api.Gauge(0), api.Gauge(1)}
+	third, err := nc.Describe(vl, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if third == first {
+		t.Errorf("Describe(%v): stale descriptor returned after type change", vl)
+	}
+
+	// changing meta data replaces the entry
+	for i := 0; i < 3; i++ {
+		if _, err := nc.DescribeWithMeta(vl, Meta{"uuid": fmt.Sprintf("uuid-%d", i)}, 1); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if n := nc.cache.len(); n != 1 {
+		t.Errorf("cache size after meta data changes: got %d, expected 1", n)
+	}
+
+	nc.Forget(vl)
+	if n := nc.cache.len(); n != 0 {
+		t.Errorf("cache size after Forget: got %d, expected 0", n)
+	}
+}
+
+func BenchmarkConvertCached(b *testing.B) {
+	nc, err := NewNameConverterWithJSON(benchConf)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+	vls := benchValueLists()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, vl := range vls {
+			for idx := range vl.Values {
+				if _, err := nc.Convert(vl, idx); err != nil {
+					b.Fatalf("%s", err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkDescribeUncached(b *testing.B) {
+	nc, err := NewNameConverterWithJSON(benchConf)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+	vls := benchValueLists()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, vl := range vls {
+			for idx := range vl.Values {
+				if _, err := nc.describe(vl, nil, idx); err != nil {
+					b.Fatalf("%s", err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkDescribeCached(b *testing.B) {
+	nc, err := NewNameConverterWithJSON(benchConf)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+	vls := benchValueLists()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, vl := range vls {
+			for idx := range vl.Values {
+				if _, err := nc.Describe(vl, idx); err != nil {
+					b.Fatalf("%s", err)
+				}
+			}
+		}
+	}
+}
@@ -5,24 +5,153 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 
 	"collectd.org/api"
 	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
 )
 
 type LabelItem struct {
-	Label string `json:"label"`
-	Ident string `json:"ident"`
+	Label string `json:"label" yaml:"label"`
+	Ident string `json:"ident" yaml:"ident"`
 }
 
 type ConfMap struct {
-	Source string                 `json:"source"`
-	Prefix string                 `json:"prefix"`
-	Name   string                 `json:"name"`
-	Labels map[string][]LabelItem `json:"labels"`
+	Source string                 `json:"source" yaml:"source"`
+	Prefix string                 `json:"prefix" yaml:"prefix"`
+	Name   string                 `json:"name" yaml:"name"`
+	Labels map[string][]LabelItem `json:"labels" yaml:"labels"`
+	Rules  []NameRule             `json:"rules,omitempty" yaml:"rules,omitempty"`
+
+	RelabelConfigs []RelabelConfig `json:"relabel_configs,omitempty" yaml:"relabel_configs,omitempty"`
+}
+
+// LoadConfMap reads a ConfMap from the file at path. Files ending in
+// ".yaml" or ".yml" are decoded as YAML, everything else as JSON.
+func LoadConfMap(path string) (*ConfMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c ConfMap
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &c)
+	default:
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse '%s': %s", path, err)
+	}
+	return &c, nil
+}
+
+// Validate checks that the name templates parse, that the name rules
+// are well formed and that every label item refers to an existing
+// VLDesc field.
+func (c *ConfMap) Validate() error {
+	if _, err := newNameTemplate(c.Name); err != nil {
+		return fmt.Errorf("Bad name template: %s", err)
+	}
+	if _, err := compileNameRules(c.Rules); err != nil {
+		return err
+	}
+	if _, err := compileRelabelConfigs(c.RelabelConfigs); err != nil {
+		return err
+	}
+	for key, items := range c.Labels {
+		if err := checkLabelsKey(key); err != nil {
+			return err
+		}
+		for i, item := range items {
+			if err := checkField(item.Label); err != nil {
+				return fmt.Errorf("labels[%q][%d]: label: %s", key, i, err)
+			}
+			if err := checkField(item.Ident); err != nil {
+				return fmt.Errorf("labels[%q][%d]: ident: %s", key, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkLabelsKey accepts "*", "plugin" and "plugin/type" keys.
+func checkLabelsKey(key string) error {
+	if key == "*" {
+		return nil
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) > 2 {
+		return fmt.Errorf("Bad labels key '%s': expected \"plugin\" or \"plugin/type\"", key)
+	}
+	for _, part := range parts {
+		if part == "" || part == "*" {
+			return fmt.Errorf("Bad labels key '%s': empty or wildcard component", key)
+		}
+	}
+	return nil
+}
+
+// newNameTemplate parses a name template. Missing meta data keys
+// expand to the empty string.
+func newNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=zero").Parse(text)
+}
+
+func checkField(name string) error {
+	if name == "" {
+		return errors.New("empty value")
+	}
+	if !strings.HasPrefix(name, "$") {
+		return nil
+	}
+	field := strings.TrimPrefix(name, "$")
+	if strings.HasPrefix(field, metaFieldPrefix) {
+		if field == metaFieldPrefix {
+			return errors.New("missing meta data key")
+		}
+		return nil
+	}
+	f, ok := reflect.TypeOf(VLDesc{}).FieldByName(field)
+	if !ok {
+		return fmt.Errorf("unknown field '%s'", field)
+	}
+	if f.Type.Kind() != reflect.String {
+		return fmt.Errorf("field '%s' is not a string", field)
+	}
+	return nil
+}
+
+// Meta holds the collectd meta data of a value list. Label rules refer
+// to its values as "$Meta.<key>", name templates as "{{.Meta.<key>}}".
+type Meta map[string]string
+
+const metaFieldPrefix = "Meta."
+
+// key returns a canonical representation of m.
+func (m Meta) key() string {
+	if len(m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m[k])
+		b.WriteByte(0)
+	}
+	return b.String()
 }
 
 type VLDesc struct {
@@ -33,15 +162,17 @@ type VLDesc struct {
 	TypeInstance   string
 	DSName         string
 	IsTotal        bool
+	Meta           Meta
 }
 
-func process(vl api.ValueList, index int) VLDesc {
+func process(vl api.ValueList, meta Meta, index int) VLDesc {
 	vldesc := VLDesc{
 		Host:           vl.Host,
 		Plugin:         vl.Plugin,
 		PluginInstance: vl.PluginInstance,
 		Type:           vl.Type,
 		TypeInstance:   vl.TypeInstance,
+		Meta:           meta,
 	}
 	if index != -1 {
 		vldesc.DSName = vl.DSName(index)
@@ -53,16 +184,25 @@ func process(vl api.ValueList, index int) VLDesc {
 	return vldesc
 }
 
+// NameConverter turns collectd values in prometheus metrics. Name
+// templates are parsed once at construction, and the descriptors are
+// cached per identifier and data source index for the lifetime of the
+// converter: to change the mapping, build a new NameConverter.
 type NameConverter struct {
-	source string
-	prefix string
-	conf   *ConfMap
+	source  string
+	prefix  string
+	conf    *ConfMap
+	name    *template.Template
+	rules   []nameRule
+	relabel []relabelStep
+	cache   *descCache
 }
 
 func NewNameConverter(source, prefix string) (*NameConverter, error) {
 	return &NameConverter{
 		source: source,
 		prefix: prefix + "_",
+		cache:  newDescCache(),
 	}, nil
 }
 
@@ -72,16 +212,67 @@ func NewNameConverterWithJSON(data []byte) (*NameConverter, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewNameConverterWithConfMap(&c)
+}
+
+func NewNameConverterWithConfMap(c *ConfMap) (*NameConverter, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var name *template.Template
+	if c.Name != "" {
+		var err error
+		name, err = newNameTemplate(c.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Bad name template: %s", err)
+		}
+	}
+	rules, err := compileNameRules(c.Rules)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := compileRelabelConfigs(c.RelabelConfigs)
+	if err != nil {
+		return nil, err
+	}
 	return &NameConverter{
-		source: c.Source,
-		prefix: c.Prefix + "_",
-		conf:   &c,
+		source:  c.Source,
+		prefix:  c.Prefix + "_",
+		conf:    c,
+		name:    name,
+		rules:   rules,
+		relabel: steps,
+		cache:   newDescCache(),
 	}, nil
+}
 
+// Forget drops the cached descriptors of vl. Call it once vl is not
+// going to be converted anymore.
+func (n *NameConverter) Forget(vl api.ValueList) {
+	n.cache.forget(vl.Identifier)
 }
 
 func (n *NameConverter) Describe(vl api.ValueList, index int) (*prometheus.Desc, error) {
-	vldesc := process(vl, index)
+	return n.DescribeWithMeta(vl, nil, index)
+}
+
+// DescribeWithMeta is like Describe, making meta available to the
+// label rules, name templates and relabeling steps.
+func (n *NameConverter) DescribeWithMeta(vl api.ValueList, meta Meta, index int) (*prometheus.Desc, error) {
+	dstype := vl.Values[index].Type()
+	key := meta.key()
+	if entry, ok := n.cache.get(vl.Identifier, index, dstype, key); ok {
+		return entry.desc, entry.err
+	}
+	desc, err := n.describe(vl, meta, index)
+	if err == nil || err == ErrDropped {
+		n.cache.put(vl.Identifier, index, dstype, key, desc, err)
+	}
+	return desc, err
+}
+
+func (n *NameConverter) describe(vl api.ValueList, meta Meta, index int) (*prometheus.Desc, error) {
+	vldesc := process(vl, meta, index)
 
 	name, err := n.convertName(vldesc)
 	if err != nil {
@@ -91,6 +282,13 @@ func (n *NameConverter) Describe(vl api.ValueList, index int) (*prometheus.Desc,
 	if err != nil {
 		return nil, err
 	}
+	if len(n.relabel) > 0 {
+		ls := relabelInput(name, labels, vldesc)
+		if !relabel(n.relabel, ls) {
+			return nil, ErrDropped
+		}
+		name, labels = relabelOutput(ls)
+	}
 
 	return prometheus.NewDesc(
 		name,
@@ -101,6 +299,12 @@ func (n *NameConverter) Describe(vl api.ValueList, index int) (*prometheus.Desc,
 }
 
 func (n *NameConverter) Convert(vl api.ValueList, index int) (prometheus.Metric, error) {
+	return n.ConvertWithMeta(vl, nil, index)
+}
+
+// ConvertWithMeta is like Convert, making meta available to the
+// label rules, name templates and relabeling steps.
+func (n *NameConverter) ConvertWithMeta(vl api.ValueList, meta Meta, index int) (prometheus.Metric, error) {
 	var prometheusType prometheus.ValueType
 	var prometheusValue float64
 
@@ -118,7 +322,7 @@ func (n *NameConverter) Convert(vl api.ValueList, index int) (prometheus.Metric,
 		return nil, fmt.Errorf("Unknown value type: %T", v)
 	}
 
-	desc, err := n.Describe(vl, index)
+	desc, err := n.DescribeWithMeta(vl, meta, index)
 	if err != nil {
 		return nil, err
 	}
@@ -126,7 +330,7 @@ func (n *NameConverter) Convert(vl api.ValueList, index int) (prometheus.Metric,
 }
 
 func (n *NameConverter) Name(vl api.ValueList, index int) (string, error) {
-	return n.convertName(process(vl, index))
+	return n.convertName(process(vl, nil, index))
 }
 
 func (n *NameConverter) convertName(vldesc VLDesc) (string, error) {
@@ -143,9 +347,20 @@ func (n *NameConverter) convertName(vldesc VLDesc) (string, error) {
 	return strings.Replace(n.prefix+name, ".", "_", -1), nil
 }
 
+// userName uses the template of the first matching name rule, then the
+// global name template and finally the builtin naming scheme.
 func (n *NameConverter) userName(vldesc VLDesc) (string, error) {
+	t := n.name
+	for i := range n.rules {
+		if n.rules[i].match(vldesc) {
+			t = n.rules[i].name
+			break
+		}
+	}
+	if t == nil {
+		return n.builtinName(vldesc)
+	}
 	buf := new(bytes.Buffer)
-	t := template.Must(template.New("name").Parse(n.conf.Name))
 	err := t.Execute(buf, vldesc)
 	if err != nil {
 		return "", err
@@ -169,7 +384,7 @@ func (n *NameConverter) builtinName(vldesc VLDesc) (string, error) {
 }
 
 func (n *NameConverter) Labels(vl api.ValueList) (prometheus.Labels, error) {
-	return n.convertLabels(process(vl, -1))
+	return n.convertLabels(process(vl, nil, -1))
 }
 
 func (n *NameConverter) convertLabels(vldesc VLDesc) (prometheus.Labels, error) {
@@ -195,22 +410,41 @@ func (n *NameConverter) builtinLabels(vldesc VLDesc) (prometheus.Labels, error)
 	return labels, nil
 }
 
+// labelItems selects the label rules for vldesc, looking up in order
+// "plugin/type", "plugin" and finally the "*" default.
+func (n *NameConverter) labelItems(vldesc VLDesc) ([]LabelItem, bool) {
+	keys := []string{
+		vldesc.Plugin + "/" + vldesc.Type,
+		vldesc.Plugin,
+		"*",
+	}
+	for _, key := range keys {
+		if items, ok := n.conf.Labels[key]; ok {
+			return items, true
+		}
+	}
+	return nil, false
+}
+
 func (n *NameConverter) userLabels(vldesc VLDesc) (prometheus.Labels, error) {
 	labels := prometheus.Labels{}
-	items, ok := n.conf.Labels["*"]
+	items, ok := n.labelItems(vldesc)
 	if !ok {
-		return labels, errors.New("No defaults")
+		return labels, fmt.Errorf("No label rules for plugin '%s' type '%s' and no defaults", vldesc.Plugin, vldesc.Type)
 	}
 	v := reflect.ValueOf(vldesc)
 	for _, item := range items {
-		labels[resolve(v, item.Label)] = resolve(v, item.Ident)
+		labels[resolve(v, vldesc.Meta, item.Label)] = resolve(v, vldesc.Meta, item.Ident)
 	}
 	return labels, nil
 }
 
-func resolve(v reflect.Value, name string) string {
+func resolve(v reflect.Value, meta Meta, name string) string {
 	if strings.HasPrefix(name, "$") {
 		name = strings.TrimPrefix(name, "$")
+		if strings.HasPrefix(name, metaFieldPrefix) {
+			return meta[strings.TrimPrefix(name, metaFieldPrefix)]
+		}
 		return v.FieldByName(name).String()
 	}
 	return name
@@ -1,7 +1,11 @@
 package nameconv
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"collectd.org/api"
@@ -195,3 +199,304 @@ func TestNameConverterLabels(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadConfMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameconv")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"map.json": `{"source": "virt", "prefix": "vce", "name": "{{.Plugin}}_{{.Type}}",
+			"labels": {"*": [{"label": "instance", "ident": "$Host"}]}}`,
+		"map.yaml": `
+source: virt
+prefix: vce
+name: "{{.Plugin}}_{{.Type}}"
+labels:
+  "*":
+    - label: instance
+      ident: $Host
+`,
+	}
+	expected := &ConfMap{
+		Source: "virt",
+		Prefix: "vce",
+		Name:   "{{.Plugin}}_{{.Type}}",
+		Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "instance", Ident: "$Host"}},
+		},
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+		got, err := LoadConfMap(path)
+		if err != nil {
+			t.Errorf("LoadConfMap(%s): %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("LoadConfMap(%s): got %#v, expected %#v", name, got, expected)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("Validate(%s): %s", name, err)
+		}
+	}
+}
+
+func TestConfMapValidate(t *testing.T) {
+	defaults := map[string][]LabelItem{
+		"*": []LabelItem{{Label: "instance", Ident: "$Host"}},
+	}
+	cases := []ConfMap{
+		{Rules: []NameRule{{Plugin: "virt"}}, Labels: defaults},
+		{Rules: []NameRule{{Plugin: "/virt(/", Name: "{{.Type}}"}}, Labels: defaults},
+		{Rules: []NameRule{{Plugin: "virt", Name: "{{.Type"}}, Labels: defaults},
+		{Name: "{{.Plugin", Labels: defaults},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"virt/": []LabelItem{{Label: "domain", Ident: "$Host"}},
+		}},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"virt/if_octets/rx": []LabelItem{{Label: "domain", Ident: "$Host"}},
+		}},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "instance", Ident: "$Hostname"}},
+		}},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "", Ident: "$Host"}},
+		}},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "uuid", Ident: "$Meta."}},
+		}},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "total", Ident: "$IsTotal"}},
+		}},
+		{Name: "{{.Plugin}}", Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "meta", Ident: "$Meta"}},
+		}},
+	}
+	for _, c := range cases {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%#v): expected error, got none", c)
+		}
+		if _, err := NewNameConverterWithConfMap(&c); err == nil {
+			t.Errorf("NewNameConverterWithConfMap(%#v): expected error, got none", c)
+		}
+	}
+}
+
+func TestNameConverterUserLabels(t *testing.T) {
+	conf := &ConfMap{
+		Source: "virt",
+		Prefix: "vce",
+		Name:   "{{.Plugin}}_{{.Type}}",
+		Labels: map[string][]LabelItem{
+			"*": []LabelItem{
+				{Label: "instance", Ident: "$Host"},
+			},
+			"virt": []LabelItem{
+				{Label: "domain", Ident: "$Host"},
+				{Label: "vcpu", Ident: "$TypeInstance"},
+			},
+			"virt/disk_octets": []LabelItem{
+				{Label: "domain", Ident: "$Host"},
+				{Label: "disk", Ident: "$TypeInstance"},
+			},
+			"interface": []LabelItem{
+				{Label: "instance", Ident: "$Host"},
+				{Label: "interface", Ident: "$PluginInstance"},
+			},
+		},
+	}
+	cases := []struct {
+		vl       api.ValueList
+		expected prometheus.Labels
+	}{
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "vm0",
+				Plugin:       "virt",
+				Type:         "virt_vcpu",
+				TypeInstance: "1",
+			},
+		}, prometheus.Labels{
+			"domain": "vm0",
+			"vcpu":   "1",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "vm0",
+				Plugin:       "virt",
+				Type:         "disk_octets",
+				TypeInstance: "vda",
+			},
+		}, prometheus.Labels{
+			"domain": "vm0",
+			"disk":   "vda",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:           "example.com",
+				Plugin:         "interface",
+				PluginInstance: "eth0",
+				Type:           "if_octets",
+			},
+		}, prometheus.Labels{
+			"instance":  "example.com",
+			"interface": "eth0",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:           "example.com",
+				Plugin:         "cpu",
+				PluginInstance: "0",
+				Type:           "cpu",
+			},
+		}, prometheus.Labels{
+			"instance": "example.com",
+		}},
+	}
+
+	nc, err := NewNameConverterWithConfMap(conf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, c := range cases {
+		got, err := nc.Labels(c.vl)
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Labels(%v): got %v, expected %v", c.vl, got, c.expected)
+		}
+	}
+
+	delete(conf.Labels, "*")
+	if _, err := nc.Labels(api.ValueList{Identifier: api.Identifier{Plugin: "load", Type: "load"}}); err == nil {
+		t.Errorf("Labels(load/load): expected error without defaults, got none")
+	}
+}
+
+func TestNameConverterNameRules(t *testing.T) {
+	conf := &ConfMap{
+		Source: "virt",
+		Prefix: "vce",
+		Labels: map[string][]LabelItem{
+			"*": []LabelItem{{Label: "instance", Ident: "$Host"}},
+		},
+		Rules: []NameRule{
+			{Plugin: "virt", Type: "/^if_/", DSName: "rx", Name: "vm_network_receive"},
+			{Plugin: "virt", Type: "/^if_/", Name: "vm_network_{{.Type}}_{{.DSName}}"},
+			{Plugin: "virt", Name: "vm_{{.Type}}"},
+			{Type: "memory", Name: "host_memory_{{.TypeInstance}}"},
+		},
+	}
+	cases := []struct {
+		vl       api.ValueList
+		index    int
+		expected string
+	}{
+		{api.ValueList{
+			Identifier: api.Identifier{Plugin: "virt", Type: "if_octets"},
+			DSNames:    []string{"rx", "tx"},
+			Values:     []api.Value{api.Derive(0), api.Derive(1)},
+		}, 0, "vce_vm_network_receive"},
+		{api.ValueList{
+			Identifier: api.Identifier{Plugin: "virt", Type: "if_octets"},
+			DSNames:    []string{"rx", "tx"},
+			Values:     []api.Value{api.Derive(0), api.Derive(1)},
+		}, 1, "vce_vm_network_if_octets_tx"},
+		{api.ValueList{
+			Identifier: api.Identifier{Plugin: "virt", Type: "virt_cpu_total"},
+			DSNames:    []string{"value"},
+			Values:     []api.Value{api.Derive(0)},
+		}, 0, "vce_vm_virt_cpu_total"},
+		{api.ValueList{
+			Identifier: api.Identifier{Plugin: "memory", Type: "memory", TypeInstance: "used"},
+			DSNames:    []string{"value"},
+			Values:     []api.Value{api.Gauge(0)},
+		}, 0, "vce_host_memory_used"},
+		{api.ValueList{
+			Identifier: api.Identifier{Plugin: "load", Type: "load"},
+			DSNames:    []string{"shortterm", "midterm", "longterm"},
+			Values:     []api.Value{api.Gauge(0), api.Gauge(0), api.Gauge(0)},
+		}, 0, "vce_load_shortterm"},
+	}
+
+	nc, err := NewNameConverterWithConfMap(conf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, c := range cases {
+		got, err := nc.Name(c.vl, c.index)
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+		if got != c.expected {
+			t.Errorf("Name(%v, %d): got %q, expected %q", c.vl, c.index, got, c.expected)
+		}
+	}
+}
+
+func TestNameConverterMeta(t *testing.T) {
+	conf := &ConfMap{
+		Source: "virt",
+		Prefix: "vce",
+		Name:   "{{.Plugin}}_{{.Type}}{{with .Meta.unit}}_{{.}}{{end}}",
+		Labels: map[string][]LabelItem{
+			"*": []LabelItem{
+				{Label: "domain", Ident: "$Host"},
+				{Label: "uuid", Ident: "$Meta.uuid"},
+			},
+		},
+	}
+	nc, err := NewNameConverterWithConfMap(conf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	vl := api.ValueList{
+		Identifier: api.Identifier{Host: "vm0", Plugin: "virt", Type: "memory"},
+		DSNames:    []string{"value"},
+		Values:     []api.Value{api.Gauge(0)},
+	}
+
+	desc, err := nc.DescribeWithMeta(vl, Meta{"uuid": "c0ffee", "unit": "bytes"}, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, s := range []string{`fqName: "vce_virt_memory_bytes"`, `domain="vm0"`, `uuid="c0ffee"`} {
+		if !strings.Contains(desc.String(), s) {
+			t.Errorf("got %s, expected %s", desc, s)
+		}
+	}
+
+	// missing meta data expand to empty strings
+	desc, err = nc.DescribeWithMeta(vl, nil, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, s := range []string{`fqName: "vce_virt_memory"`, `uuid=""`} {
+		if !strings.Contains(desc.String(), s) {
+			t.Errorf("got %s, expected %s", desc, s)
+		}
+	}
+
+	conf.RelabelConfigs = []RelabelConfig{
+		{SourceLabels: []string{"__meta_vm_name"}, Regex: "(.+)", TargetLabel: "name", Replacement: "$1"},
+	}
+	nc, err = NewNameConverterWithConfMap(conf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	desc, err = nc.DescribeWithMeta(vl, Meta{"vm.name": "web"}, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !strings.Contains(desc.String(), `name="web"`) {
+		t.Errorf("got %s, expected name=\"web\"", desc)
+	}
+}
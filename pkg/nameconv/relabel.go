@@ -0,0 +1,224 @@
+package nameconv
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrDropped is returned when a value is discarded by a keep or drop
+// relabeling step.
+var ErrDropped = errors.New("Dropped by relabeling")
+
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelHashMod   = "hashmod"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+// labels with this prefix are available to the relabeling steps but
+// are removed from the final label set, like in Prometheus.
+const reservedLabelPrefix = "__"
+
+// the meta data are available to the relabeling steps as __meta_<key>.
+const metaLabelPrefix = "__meta_"
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// RelabelConfig mirrors the Prometheus relabel_configs entries.
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels,omitempty" yaml:"source_labels,flow,omitempty"`
+	Separator    string   `json:"separator,omitempty" yaml:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Modulus      uint64   `json:"modulus,omitempty" yaml:"modulus,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty" yaml:"target_label,omitempty"`
+	Replacement  string   `json:"replacement,omitempty" yaml:"replacement,omitempty"`
+	Action       string   `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+// DefaultRelabelConfig holds the values used for the fields missing
+// from a relabeling step, the same Prometheus uses.
+var DefaultRelabelConfig = RelabelConfig{
+	Separator:   ";",
+	Regex:       "(.*)",
+	Replacement: "$1",
+	Action:      RelabelReplace,
+}
+
+func (c *RelabelConfig) UnmarshalJSON(data []byte) error {
+	*c = DefaultRelabelConfig
+	type plain RelabelConfig
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultRelabelConfig
+	type plain RelabelConfig
+	return unmarshal((*plain)(c))
+}
+
+type relabelStep struct {
+	RelabelConfig
+	re *regexp.Regexp
+}
+
+func compileRelabelConfigs(confs []RelabelConfig) ([]relabelStep, error) {
+	var steps []relabelStep
+	for i, conf := range confs {
+		if conf.Action == "" {
+			conf.Action = RelabelReplace
+		}
+		conf.Action = strings.ToLower(conf.Action)
+		re, err := regexp.Compile("^(?:" + conf.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel_configs[%d]: bad regex: %s", i, err)
+		}
+		switch conf.Action {
+		case RelabelReplace:
+			if conf.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel_configs[%d]: missing target_label for action '%s'", i, conf.Action)
+			}
+		case RelabelHashMod:
+			if conf.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel_configs[%d]: missing target_label for action '%s'", i, conf.Action)
+			}
+			if conf.Modulus == 0 {
+				return nil, fmt.Errorf("relabel_configs[%d]: missing modulus for action '%s'", i, conf.Action)
+			}
+		case RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel_configs[%d]: unknown action '%s'", i, conf.Action)
+		}
+		for _, name := range conf.SourceLabels {
+			if !labelNameRE.MatchString(name) {
+				return nil, fmt.Errorf("relabel_configs[%d]: bad source label '%s'", i, name)
+			}
+		}
+		steps = append(steps, relabelStep{RelabelConfig: conf, re: re})
+	}
+	return steps, nil
+}
+
+// relabel applies the steps in order to labels, in place. Returns false
+// if the value must be dropped.
+func relabel(steps []relabelStep, labels prometheus.Labels) bool {
+	for i := range steps {
+		if !steps[i].apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *relabelStep) apply(labels prometheus.Labels) bool {
+	values := make([]string, 0, len(s.SourceLabels))
+	for _, name := range s.SourceLabels {
+		values = append(values, labels[name])
+	}
+	val := strings.Join(values, s.Separator)
+
+	switch s.Action {
+	case RelabelKeep:
+		return s.re.MatchString(val)
+	case RelabelDrop:
+		return !s.re.MatchString(val)
+	case RelabelReplace:
+		indexes := s.re.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+		target := string(s.re.ExpandString([]byte{}, s.TargetLabel, val, indexes))
+		if !labelNameRE.MatchString(target) {
+			break
+		}
+		res := string(s.re.ExpandString([]byte{}, s.Replacement, val, indexes))
+		if res == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = res
+		}
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % s.Modulus
+		labels[s.TargetLabel] = fmt.Sprintf("%d", mod)
+	case RelabelLabelMap:
+		mapped := prometheus.Labels{}
+		for name, value := range labels {
+			if s.re.MatchString(name) {
+				mapped[s.re.ReplaceAllString(name, s.Replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			labels[name] = value
+		}
+	case RelabelLabelDrop:
+		for name := range labels {
+			if s.re.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case RelabelLabelKeep:
+		for name := range labels {
+			if !s.re.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+// relabelInput builds the label set seen by the relabeling steps: the
+// converted labels, the metric name as __name__ and the raw VLDesc
+// fields as __host__, __plugin__, __plugin_instance__, __type__,
+// __type_instance__ and __dsname__, and the meta data as __meta_<key>.
+func relabelInput(name string, labels prometheus.Labels, vldesc VLDesc) prometheus.Labels {
+	ls := prometheus.Labels{
+		"__name__":            name,
+		"__host__":            vldesc.Host,
+		"__plugin__":          vldesc.Plugin,
+		"__plugin_instance__": vldesc.PluginInstance,
+		"__type__":            vldesc.Type,
+		"__type_instance__":   vldesc.TypeInstance,
+		"__dsname__":          vldesc.DSName,
+	}
+	for k, v := range vldesc.Meta {
+		ls[metaLabelPrefix+sanitizeLabelName(k)] = v
+	}
+	for k, v := range labels {
+		ls[k] = v
+	}
+	return ls
+}
+
+// sanitizeLabelName replaces the characters not allowed in label names.
+func sanitizeLabelName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// relabelOutput splits the relabeled set back in metric name and
+// labels, discarding the reserved labels.
+func relabelOutput(ls prometheus.Labels) (string, prometheus.Labels) {
+	name := ls["__name__"]
+	labels := prometheus.Labels{}
+	for k, v := range ls {
+		if !strings.HasPrefix(k, reservedLabelPrefix) {
+			labels[k] = v
+		}
+	}
+	return name, labels
+}
@@ -0,0 +1,153 @@
+package nameconv
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRelabel(t *testing.T) {
+	cases := []struct {
+		confs    string
+		input    prometheus.Labels
+		expected prometheus.Labels
+	}{
+		{`[{"source_labels": ["__plugin__", "__type_instance__"], "regex": "virt;(.*)", "target_label": "vcpu"}]`,
+			prometheus.Labels{"__plugin__": "virt", "__type_instance__": "1"},
+			prometheus.Labels{"__plugin__": "virt", "__type_instance__": "1", "vcpu": "1"},
+		},
+		{`[{"source_labels": ["a"], "regex": "nomatch", "target_label": "b", "replacement": "x"}]`,
+			prometheus.Labels{"a": "foo"},
+			prometheus.Labels{"a": "foo"},
+		},
+		{`[{"source_labels": ["a"], "regex": "f(o+)", "target_label": "${1}_label", "replacement": "bar"}]`,
+			prometheus.Labels{"a": "foo"},
+			prometheus.Labels{"a": "foo", "oo_label": "bar"},
+		},
+		{`[{"source_labels": ["a"], "target_label": "b", "replacement": ""}]`,
+			prometheus.Labels{"a": "foo", "b": "bar"},
+			prometheus.Labels{"a": "foo"},
+		},
+		{`[{"action": "labelmap", "regex": "__(plugin|type)__"}]`,
+			prometheus.Labels{"__plugin__": "cpu", "__type__": "percent", "__host__": "h"},
+			prometheus.Labels{"__plugin__": "cpu", "__type__": "percent", "__host__": "h", "plugin": "cpu", "type": "percent"},
+		},
+		{`[{"action": "labeldrop", "regex": "cpu|type"}]`,
+			prometheus.Labels{"cpu": "0", "type": "user", "instance": "h"},
+			prometheus.Labels{"instance": "h"},
+		},
+		{`[{"action": "labelkeep", "regex": "__.*|instance"}]`,
+			prometheus.Labels{"__name__": "x", "cpu": "0", "instance": "h"},
+			prometheus.Labels{"__name__": "x", "instance": "h"},
+		},
+		{`[{"action": "hashmod", "source_labels": ["instance"], "modulus": 1, "target_label": "shard"}]`,
+			prometheus.Labels{"instance": "h"},
+			prometheus.Labels{"instance": "h", "shard": "0"},
+		},
+		{`[{"action": "keep", "source_labels": ["__plugin__"], "regex": "virt"}]`,
+			prometheus.Labels{"__plugin__": "cpu"},
+			nil,
+		},
+		{`[{"action": "drop", "source_labels": ["__plugin__"], "regex": "cpu"}]`,
+			prometheus.Labels{"__plugin__": "cpu"},
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		var confs []RelabelConfig
+		if err := json.Unmarshal([]byte(c.confs), &confs); err != nil {
+			t.Fatalf("%s: %s", c.confs, err)
+		}
+		steps, err := compileRelabelConfigs(confs)
+		if err != nil {
+			t.Errorf("%s: %s", c.confs, err)
+			continue
+		}
+		keep := relabel(steps, c.input)
+		if c.expected == nil {
+			if keep {
+				t.Errorf("%s: expected drop, got %v", c.confs, c.input)
+			}
+			continue
+		}
+		if !keep {
+			t.Errorf("%s: unexpected drop", c.confs)
+		} else if !reflect.DeepEqual(c.input, c.expected) {
+			t.Errorf("%s: got %v, expected %v", c.confs, c.input, c.expected)
+		}
+	}
+}
+
+func TestRelabelConfigsInvalid(t *testing.T) {
+	cases := []string{
+		`[{"action": "replace"}]`,
+		`[{"action": "hashmod", "target_label": "shard"}]`,
+		`[{"action": "frobnicate"}]`,
+		`[{"action": "keep", "regex": "(unbalanced"}]`,
+		`[{"action": "keep", "source_labels": ["bad-name"]}]`,
+	}
+	for _, c := range cases {
+		var confs []RelabelConfig
+		if err := json.Unmarshal([]byte(c), &confs); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if _, err := compileRelabelConfigs(confs); err == nil {
+			t.Errorf("%s: expected error, got none", c)
+		}
+	}
+}
+
+func TestNameConverterRelabel(t *testing.T) {
+	data := []byte(`{
+		"source": "virt",
+		"prefix": "vce",
+		"labels": {"*": [{"label": "instance", "ident": "$Host"}]},
+		"relabel_configs": [
+			{"action": "drop", "source_labels": ["__plugin__"], "regex": "load"},
+			{"source_labels": ["__plugin__", "__type_instance__"], "regex": "virt;(.+)", "target_label": "vcpu"},
+			{"source_labels": ["__name__"], "regex": "vce_virt_(.*)", "target_label": "__name__", "replacement": "vm_$1"}
+		]
+	}`)
+	nc, err := NewNameConverterWithJSON(data)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	vl := api.ValueList{
+		Identifier: api.Identifier{
+			Host:         "vm0",
+			Plugin:       "virt",
+			Type:         "virt_vcpu",
+			TypeInstance: "0",
+		},
+		DSNames: []string{"value"},
+		Values:  []api.Value{api.Derive(0)},
+	}
+	desc, err := nc.Describe(vl, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	got := desc.String()
+	for _, s := range []string{`fqName: "vm_virt_vcpu_total"`, `instance="vm0"`, `vcpu="0"`} {
+		if !strings.Contains(got, s) {
+			t.Errorf("Describe(%v): %q not found in %s", vl, s, got)
+		}
+	}
+	if strings.Contains(got, "__") {
+		t.Errorf("Describe(%v): reserved labels leaked in %s", vl, got)
+	}
+
+	vl = api.ValueList{
+		Identifier: api.Identifier{Plugin: "load", Type: "load"},
+		DSNames:    []string{"shortterm"},
+		Values:     []api.Value{api.Gauge(0)},
+	}
+	if _, err := nc.Convert(vl, 0); err != ErrDropped {
+		t.Errorf("Convert(%v): got %v, expected %v", vl, err, ErrDropped)
+	}
+}
@@ -0,0 +1,80 @@
+package nameconv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// NameRule overrides the metric name template for the values matching
+// all of its non-empty Plugin, Type and DSName fields. A field enclosed
+// in slashes, like "/^if_.*/", is a regular expression, otherwise it
+// must match exactly.
+type NameRule struct {
+	Plugin string `json:"plugin,omitempty" yaml:"plugin,omitempty"`
+	Type   string `json:"type,omitempty" yaml:"type,omitempty"`
+	DSName string `json:"dsname,omitempty" yaml:"dsname,omitempty"`
+	Name   string `json:"name" yaml:"name"`
+}
+
+type fieldMatcher struct {
+	exact string
+	re    *regexp.Regexp
+}
+
+func newFieldMatcher(expr string) (fieldMatcher, error) {
+	if len(expr) >= 2 && strings.HasPrefix(expr, "/") && strings.HasSuffix(expr, "/") {
+		re, err := regexp.Compile(expr[1 : len(expr)-1])
+		if err != nil {
+			return fieldMatcher{}, err
+		}
+		return fieldMatcher{re: re}, nil
+	}
+	return fieldMatcher{exact: expr}, nil
+}
+
+func (m fieldMatcher) match(s string) bool {
+	if m.re != nil {
+		return m.re.MatchString(s)
+	}
+	return m.exact == "" || m.exact == s
+}
+
+type nameRule struct {
+	plugin fieldMatcher
+	typ    fieldMatcher
+	dsname fieldMatcher
+	name   *template.Template
+}
+
+func (r *nameRule) match(vldesc VLDesc) bool {
+	return r.plugin.match(vldesc.Plugin) &&
+		r.typ.match(vldesc.Type) &&
+		r.dsname.match(vldesc.DSName)
+}
+
+func compileNameRules(rules []NameRule) ([]nameRule, error) {
+	var ret []nameRule
+	for i, rule := range rules {
+		var err error
+		nr := nameRule{}
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rules[%d]: missing name template", i)
+		}
+		if nr.name, err = newNameTemplate(rule.Name); err != nil {
+			return nil, fmt.Errorf("rules[%d]: bad name template: %s", i, err)
+		}
+		if nr.plugin, err = newFieldMatcher(rule.Plugin); err != nil {
+			return nil, fmt.Errorf("rules[%d]: plugin: %s", i, err)
+		}
+		if nr.typ, err = newFieldMatcher(rule.Type); err != nil {
+			return nil, fmt.Errorf("rules[%d]: type: %s", i, err)
+		}
+		if nr.dsname, err = newFieldMatcher(rule.DSName); err != nil {
+			return nil, fmt.Errorf("rules[%d]: dsname: %s", i, err)
+		}
+		ret = append(ret, nr)
+	}
+	return ret, nil
+}